@@ -0,0 +1,503 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	diamond "github.com/aerth/diamond/lib"
+	"github.com/gdamore/tcell"
+)
+
+// maxLines of history and events to keep on screen
+const maxLines = 1000
+
+// button is a menu item at the bottom of the dashboard
+type button struct {
+	label string
+	cmd   string
+	x, y  int // where it was last drawn
+}
+
+// dashboard is the interactive admin screen, with a status panel, command
+// history, live event log, menu buttons and command entry
+type dashboard struct {
+	screen  tcell.Screen
+	client  *diamond.Client
+	status  *diamond.Status
+	staterr error
+	history []string // commands sent and their replies
+	scroll  int      // lines scrolled back from end of history
+	events  []string
+	buttons []*button
+	sel     int // selected button, or -1 for the command entry
+	input   []rune
+	cursor  int
+	recall  []string // previous commands, saved across sessions
+	pos     int      // position in recall while using up/down
+	draft   []rune   // input before recalling
+}
+
+// statusUpdate is posted to the screen by the poller
+type statusUpdate struct {
+	status *diamond.Status
+	events []diamond.Event
+	err    error
+}
+
+// cmdReply is posted to the screen when a command returns
+type cmdReply struct {
+	cmd   string
+	reply string
+	err   error
+}
+
+// newButtons for the menu, with runlevels labelled by the server's names
+func newButtons(client *diamond.Client) []*button {
+	buttons := []*button{
+		{label: "Halt", cmd: "runlevel 0"},
+		{label: "Single User Mode", cmd: "runlevel 1"},
+		{label: "Runlevel 2", cmd: "runlevel 2"},
+		{label: "Multi User Mode", cmd: "runlevel 3"},
+		{label: "Runlevel 4", cmd: "runlevel 4"},
+		{label: "Check Server Status", cmd: cmdStatus},
+		{label: "Redeploy Server", cmd: cmdRedeploy},
+		{label: "Quit Admin", cmd: "quit"},
+	}
+	if names, err := client.Runlevels(); err == nil {
+		for _, r := range names {
+			if r.Level >= 0 && r.Level <= 4 {
+				buttons[r.Level].label = fmt.Sprintf("%d %s", r.Level, strings.Title(r.Name))
+			}
+		}
+	}
+	return buttons
+}
+
+func doCUI(socketpath string) {
+	client := buildClient()
+	screen, err := tcell.NewScreen()
+	if err == nil {
+		err = screen.Init()
+	}
+	if err != nil {
+		println(err.Error())
+		return
+	}
+	screen.EnableMouse()
+	d := &dashboard{
+		screen:  screen,
+		client:  client,
+		buttons: newButtons(client),
+		sel:     -1,
+		recall:  loadHistory(),
+	}
+	d.pos = len(d.recall)
+	d.addHistory("Connected to: " + client.ServerName + " (" + socketpath + ")")
+	go d.poll()
+	d.loop()
+	screen.Fini()
+	println("Check for updates often! https://github.com/aerth/diamond")
+}
+
+// poll the server for status and events, posting updates to the screen
+func (d *dashboard) poll() {
+	var since int
+	for {
+		u := new(statusUpdate)
+		u.status, u.err = d.client.Status()
+		if u.err == nil {
+			u.events, u.err = d.client.Events(since)
+			if len(u.events) > 0 {
+				since = u.events[len(u.events)-1].Seq
+			}
+		}
+		if d.screen.PostEvent(tcell.NewEventInterrupt(u)) != nil {
+			return
+		}
+		time.Sleep(*refreshtime)
+	}
+}
+
+// loop handles input and updates until quit
+func (d *dashboard) loop() {
+	for {
+		d.draw()
+		switch ev := d.screen.PollEvent().(type) {
+		case nil:
+			return
+		case *tcell.EventResize:
+			d.screen.Sync()
+		case *tcell.EventInterrupt:
+			d.update(ev.Data())
+		case *tcell.EventMouse:
+			if ev.Buttons()&tcell.Button1 == 0 {
+				continue
+			}
+			x, y := ev.Position()
+			for _, b := range d.buttons {
+				if y == b.y && x >= b.x && x < b.x+len(b.label)+2 {
+					if d.run(b.cmd) {
+						return
+					}
+				}
+			}
+		case *tcell.EventKey:
+			if d.key(ev) {
+				return
+			}
+		}
+	}
+}
+
+func (d *dashboard) update(data interface{}) {
+	switch v := data.(type) {
+	case *statusUpdate:
+		d.status, d.staterr = v.status, v.err
+		for _, e := range v.events {
+			d.events = appendLines(d.events, e.String())
+		}
+	case *cmdReply:
+		if v.err != nil {
+			d.addHistory("! " + v.err.Error())
+			return
+		}
+		d.addHistory(v.reply)
+	}
+}
+
+// key handles a key press, returning true to quit
+func (d *dashboard) key(ev *tcell.EventKey) bool {
+	switch ev.Key() {
+	case tcell.KeyEscape, tcell.KeyCtrlC, tcell.KeyCtrlQ:
+		return true
+	case tcell.KeyTab, tcell.KeyBacktab:
+		if d.sel < 0 {
+			d.sel = 0
+		} else {
+			d.sel = -1
+		}
+		return false
+	case tcell.KeyPgUp:
+		d.scroll += 5
+		return false
+	case tcell.KeyPgDn:
+		d.scroll -= 5
+		if d.scroll < 0 {
+			d.scroll = 0
+		}
+		return false
+	}
+	if d.sel >= 0 { // menu buttons
+		switch ev.Key() {
+		case tcell.KeyLeft, tcell.KeyUp:
+			d.sel = (d.sel + len(d.buttons) - 1) % len(d.buttons)
+		case tcell.KeyRight, tcell.KeyDown:
+			d.sel = (d.sel + 1) % len(d.buttons)
+		case tcell.KeyEnter:
+			return d.run(d.buttons[d.sel].cmd)
+		}
+		return false
+	}
+	switch ev.Key() { // command entry, with readline style keys
+	case tcell.KeyEnter:
+		cmd := strings.TrimSpace(string(d.input))
+		d.input, d.cursor, d.draft = nil, 0, nil
+		if cmd == "" {
+			return false
+		}
+		d.remember(cmd)
+		return d.run(cmd)
+	case tcell.KeyUp, tcell.KeyCtrlP:
+		if d.pos > 0 {
+			if d.pos == len(d.recall) {
+				d.draft = d.input
+			}
+			d.pos--
+			d.setInput([]rune(d.recall[d.pos]))
+		}
+	case tcell.KeyDown, tcell.KeyCtrlN:
+		if d.pos < len(d.recall) {
+			d.pos++
+			if d.pos == len(d.recall) {
+				d.setInput(d.draft)
+			} else {
+				d.setInput([]rune(d.recall[d.pos]))
+			}
+		}
+	case tcell.KeyLeft, tcell.KeyCtrlB:
+		if d.cursor > 0 {
+			d.cursor--
+		}
+	case tcell.KeyRight, tcell.KeyCtrlF:
+		if d.cursor < len(d.input) {
+			d.cursor++
+		}
+	case tcell.KeyHome, tcell.KeyCtrlA:
+		d.cursor = 0
+	case tcell.KeyEnd, tcell.KeyCtrlE:
+		d.cursor = len(d.input)
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if d.cursor > 0 {
+			d.input = append(d.input[:d.cursor-1], d.input[d.cursor:]...)
+			d.cursor--
+		}
+	case tcell.KeyDelete, tcell.KeyCtrlD:
+		if d.cursor < len(d.input) {
+			d.input = append(d.input[:d.cursor], d.input[d.cursor+1:]...)
+		}
+	case tcell.KeyCtrlK: // kill to end of line
+		d.input = d.input[:d.cursor]
+	case tcell.KeyCtrlU: // kill to start of line
+		d.input = append([]rune(nil), d.input[d.cursor:]...)
+		d.cursor = 0
+	case tcell.KeyCtrlW: // kill previous word
+		i := d.cursor
+		for i > 0 && d.input[i-1] == ' ' {
+			i--
+		}
+		for i > 0 && d.input[i-1] != ' ' {
+			i--
+		}
+		d.input = append(d.input[:i], d.input[d.cursor:]...)
+		d.cursor = i
+	case tcell.KeyRune:
+		d.input = append(d.input[:d.cursor], append([]rune{ev.Rune()}, d.input[d.cursor:]...)...)
+		d.cursor++
+	}
+	return false
+}
+
+// setInput replaces the command entry, with the cursor at the end
+func (d *dashboard) setInput(r []rune) {
+	d.input = append([]rune(nil), r...)
+	d.cursor = len(d.input)
+}
+
+// remember a command in the history file
+func (d *dashboard) remember(cmd string) {
+	if len(d.recall) == 0 || d.recall[len(d.recall)-1] != cmd {
+		d.recall = append(d.recall, cmd)
+	}
+	d.pos = len(d.recall)
+	if err := saveHistory(d.recall); err != nil {
+		d.addHistory("! history: " + err.Error())
+	}
+}
+
+// run a command in the background, returning true to quit
+func (d *dashboard) run(cmd string) bool {
+	if cmd == "quit" {
+		return true
+	}
+	d.addHistory("> " + cmd)
+	d.scroll = 0
+	go func() {
+		r := &cmdReply{cmd: cmd}
+		if cmd == cmdStatus {
+			var st *diamond.Status
+			st, r.err = d.client.Status()
+			if r.err == nil {
+				r.reply = formatStatus(st)
+			}
+		} else {
+			r.reply, r.err = send(d.client, strings.Fields(cmd))
+		}
+		d.screen.PostEvent(tcell.NewEventInterrupt(r))
+	}()
+	return false
+}
+
+func (d *dashboard) addHistory(s string) {
+	d.history = appendLines(d.history, s)
+}
+
+// appendLines appends each line of s, keeping at most maxLines
+func appendLines(lines []string, s string) []string {
+	lines = append(lines, strings.Split(strings.TrimRight(s, "\n"), "\n")...)
+	if n := len(lines) - maxLines; n > 0 {
+		lines = append(lines[:0], lines[n:]...)
+	}
+	return lines
+}
+
+func formatStatus(st *diamond.Status) string {
+	line := fmt.Sprintf("level %s │ listeners %d/%d │ connections %d │ uptime %s │ pid %d",
+		formatLevel(st), st.Open, st.Listeners, st.Conns, st.Uptime.Round(time.Second), st.PID)
+	if role := formatRole(st); role != "" {
+		line += " │ " + role
+	}
+	return line
+}
+
+// formatLevel shows the runlevel and its name, and the boot target while booting
+func formatLevel(st *diamond.Status) string {
+	level := strconv.Itoa(st.Level)
+	if st.LevelName != "" {
+		level += " " + st.LevelName
+	}
+	switch st.Boot {
+	case diamond.Booting:
+		return fmt.Sprintf("%s (booting to %d)", level, st.BootTarget)
+	case diamond.BootFailed:
+		return level + " (boot failed)"
+	}
+	return level
+}
+
+// formatRole shows both processes while a canary runs
+func formatRole(st *diamond.Status) string {
+	switch st.Role {
+	case "incumbent":
+		return fmt.Sprintf("incumbent, canary pid %d until %s", st.Peer, st.CanaryUntil.Format("15:04:05"))
+	case "canary":
+		return fmt.Sprintf("canary of pid %d", st.Peer)
+	}
+	return ""
+}
+
+var (
+	styleTitle    = tcell.StyleDefault.Bold(true)
+	styleFrame    = tcell.StyleDefault.Foreground(tcell.ColorTeal)
+	styleError    = tcell.StyleDefault.Foreground(tcell.ColorRed)
+	styleButton   = tcell.StyleDefault.Reverse(true)
+	styleSelected = tcell.StyleDefault.Reverse(true).Bold(true).Foreground(tcell.ColorYellow)
+)
+
+func (d *dashboard) draw() {
+	s := d.screen
+	s.Clear()
+	w, h := s.Size()
+	puts(s, 0, 0, w, styleTitle, "⋄ DIAMOND CMD ─ "+d.client.ServerName+" ─ "+d.client.GetSocket())
+	if d.staterr != nil {
+		puts(s, 0, 1, w, styleError, "status: "+d.staterr.Error())
+	} else if d.status != nil {
+		puts(s, 0, 1, w, tcell.StyleDefault, formatStatus(d.status))
+	}
+
+	// buttons, wrapping upwards from above the command entry
+	var rows [][]*button
+	var x int
+	for _, b := range d.buttons {
+		if len(rows) == 0 || x+len(b.label)+3 > w {
+			rows = append(rows, nil)
+			x = 0
+		}
+		rows[len(rows)-1] = append(rows[len(rows)-1], b)
+		x += len(b.label) + 3
+	}
+	bottom := h - 2 - len(rows) // row of the lower frame
+	for i, row := range rows {
+		x = 0
+		for _, b := range row {
+			b.x, b.y = x, bottom+1+i
+			style := styleButton
+			if d.sel >= 0 && d.buttons[d.sel] == b {
+				style = styleSelected
+			}
+			puts(s, b.x, b.y, w, style, " "+b.label+" ")
+			x += len(b.label) + 3
+		}
+	}
+
+	// panels
+	half := w / 2
+	hline(s, 2, w, "─ History ")
+	puts(s, half, 2, w, styleFrame, "┬─ Events ")
+	hline(s, bottom, w, "")
+	for y := 3; y < bottom; y++ {
+		s.SetContent(half, y, '│', nil, styleFrame)
+	}
+	d.drawLines(d.history, 0, 3, half-1, bottom-3, d.scroll)
+	d.drawLines(d.events, half+2, 3, w-half-2, bottom-3, 0)
+
+	// command entry
+	prompt := "Command: "
+	puts(s, 0, h-1, w, styleTitle, prompt)
+	puts(s, len(prompt), h-1, w, tcell.StyleDefault, string(d.input))
+	if d.sel < 0 {
+		s.ShowCursor(len(prompt)+d.cursor, h-1)
+	} else {
+		s.HideCursor()
+	}
+	s.Show()
+}
+
+// drawLines draws the end of lines (wrapped to width) into a box, skipping
+// the last back lines
+func (d *dashboard) drawLines(lines []string, x, y, width, height, back int) {
+	if width < 1 || height < 1 {
+		return
+	}
+	var wrapped []string
+	for _, l := range lines {
+		r := []rune(l)
+		for len(r) > width {
+			wrapped = append(wrapped, string(r[:width]))
+			r = r[width:]
+		}
+		wrapped = append(wrapped, string(r))
+	}
+	end := len(wrapped) - back
+	if end < height {
+		end = height
+	}
+	if end > len(wrapped) {
+		end = len(wrapped)
+	}
+	start := end - height
+	if start < 0 {
+		start = 0
+	}
+	for i, l := range wrapped[start:end] {
+		style := tcell.StyleDefault
+		if strings.HasPrefix(l, "! ") {
+			style = styleError
+		}
+		puts(d.screen, x, y+i, x+width, style, l)
+	}
+}
+
+// hline draws a horizontal frame line with an optional label
+func hline(s tcell.Screen, y, w int, label string) {
+	for x := 0; x < w; x++ {
+		s.SetContent(x, y, '─', nil, styleFrame)
+	}
+	puts(s, 0, y, w, styleFrame, label)
+}
+
+// puts writes str at x,y, stopping at column max
+func puts(s tcell.Screen, x, y, max int, style tcell.Style, str string) {
+	for _, r := range str {
+		if x >= max {
+			return
+		}
+		s.SetContent(x, y, r, nil, style)
+		x++
+	}
+}
@@ -26,33 +26,35 @@
 package main
 
 import (
-	"bytes"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"strings"
 	"time"
 
-	"github.com/aerth/clix"
 	diamond "github.com/aerth/diamond/lib"
 )
 
 var (
 	sock        = flag.String("s", "", "path to socket")
-	refreshtime = flag.Duration("r", time.Minute*30, "refresh status duration")
+	refreshtime = flag.Duration("r", time.Second*2, "refresh status duration")
+	match       = flag.String("m", "", "only control sockets with names matching glob pattern")
+	level       = flag.Int("l", -1, "only control sockets currently in runlevel")
+	tokenfile   = flag.String("token", "", "file with token for servers requiring one to KICK")
 	clientname  = "ADMIN" // use linker flag to change at compilation time
 	socketpath  string    // use linker flag or CLI flag
 )
 
 const (
-	cmdStatus   = "status"
-	cmdRedeploy = "redeploy"
-	stderr      = "stderr"
-)
-
-var (
-//msg, resp string // to display in the Entry screen
-//resperr   error
+	cmdStatus    = "status"
+	cmdRedeploy  = "redeploy"
+	cmdListeners = "listeners"
+	cmdHistory   = "history"
+	cmdReload    = "reload"
+	cmdRunlevels = "runlevels"
+	stderr       = "stderr"
 )
 
 func init() {
@@ -69,9 +71,27 @@ func main() {
 	if *sock != "" {
 		socketpath = *sock
 	}
+	paths, multi, err := resolveSockets(socketpath)
+	if err != nil {
+		println(err.Error())
+		os.Exit(2)
+	}
+	if *rolling { // one or many sockets, cycled through runlevel 1
+		os.Exit(doRolling(paths))
+	}
+	if *script != "" { // script file, no menu
+		if multi {
+			println("Need a single socket to run a script")
+			os.Exit(2)
+		}
+		os.Exit(doScript(buildClient(), *script))
+	}
+	if multi { // glob or directory of sockets, no menu
+		os.Exit(doFleet(paths, flag.Args()))
+	}
 	if len(flag.Args()) > 0 { // custom CLI command, no menu
 		client := buildClient()
-		reply, err := client.Send(flag.Args()[0], strings.Join(flag.Args()[1:], " "))
+		reply, err := send(client, flag.Args())
 		if err != nil {
 			println(err.Error())
 		}
@@ -86,133 +106,43 @@ func main() {
 	doCUI(socketpath)
 }
 
-func quit(mm *clix.MenuBar) {
-	mm.GetScreen().Fini()
-	println("Check for updates often! https://github.com/aerth/diamond")
-}
-
-func buildWindow() *clix.MenuBar {
-	mm := clix.NewMenuBar(nil)
-	mm.SetMessage("⋄ DIAMOND CMD v0.3")
-	scrol := clix.NewScrollFrame("⋄")
-	mm.AttachScroller(scrol)
-	return mm
-}
-
-func buildMenu(mm *clix.MenuBar) {
-	entry := clix.NewEntry(mm.GetScreen())
-	mm.AddEntry("Command", entry) // manual command
-	mm.NewItem("Quit Admin")
-
-}
-
-func handleKeyMouse(mm *clix.MenuBar) *clix.EventHandler {
-	ev := clix.NewEventHandler()
-	ev.AddMenuBar(mm)
-	ev.Launch()
-	mm.GetScreen().Show()
-	return ev
-}
-func handleMenuInput(mm *clix.MenuBar, ev *clix.EventHandler) (cmd string) {
-	select {
-	case <-time.After(*refreshtime):
-		cmd = cmdStatus
-	case c := <-ev.Output:
-		mm.GetScreen().Show()
-		switch c.(string) {
-		case "Quit Admin":
-			cmd = "quit"
-		case "Check Server Status":
-			cmd = cmdStatus
-		case "Single User Mode":
-			cmd = "runlevel 1"
-		case "Multi User Mode":
-			cmd = "runlevel 3"
-		case "Redeploy Server":
-			cmd = cmdRedeploy
-		default: // custom command
-			cmd = c.(string)
-		}
-	}
-
-	return cmd
-}
-
 func notrunning() {
 	println("Server might not be running. Fix that first.")
 	os.Exit(2)
 }
 
 func buildClient() *diamond.Client {
-	client, e := diamond.NewClient(socketpath)
+	client, e := dial(socketpath)
 	if e != nil {
 		println(e.Error())
-		os.Exit(2)
+		notrunning()
+	}
+	return client
+}
+
+// dial connects to the socket and says HELLO
+func dial(path string) (*diamond.Client, error) {
+	client, e := diamond.NewClient(path)
+	if e != nil {
+		return nil, e
 	}
 	client.Name = clientname
+	if *tokenfile != "" {
+		token, err := ioutil.ReadFile(*tokenfile)
+		if err != nil {
+			return nil, err
+		}
+		client.Token = strings.TrimSpace(string(token))
+	}
 	r, e := client.Send("HELLO", "from "+client.Name)
 	if e != nil {
-		if strings.Contains(e.Error(), "no such file or directory") {
-			notrunning()
-			os.Exit(2)
-		} else {
-			println(e.Error())
-			notrunning()
-			os.Exit(2)
-		}
-
+		return nil, e
 	}
 
 	if !strings.HasPrefix(r, "HELLO from ") {
-		println("Can't connect to socket")
-		os.Exit(2)
+		return nil, fmt.Errorf("can't connect to socket, got %q", r)
 	}
 
 	client.ServerName = strings.TrimPrefix(r, "HELLO from ")
-	return client
-}
-
-func doCUI(socketpath string) {
-	var buf = new(bytes.Buffer)
-	client := buildClient()
-	mm := buildWindow()
-	buildMenu(mm)
-	var msg string
-	var resperr error
-	for {
-		if msg == "" {
-			msg = "Connected to: " + client.ServerName
-		}
-		if msg != "" {
-			mm.GetScroller().Buffer.Truncate(0)
-			mm.GetScroller().Buffer.WriteString(msg)
-			mm.GetScroller().Buffer.WriteString("\n")
-		}
-		// Reset messages each loop after setting message
-		mm.GetScroller().ScrollToEnd()
-		ev := handleKeyMouse(mm)
-		cmd := handleMenuInput(mm, ev)
-
-		if cmd == "quit" {
-			quit(mm)
-			return
-		}
-		if cmd != "" {
-			buf.WriteString("SENT: " + cmd)
-
-			argv := strings.Split(cmd, " ")
-			if len(argv) < 2 {
-				msg, resperr = client.Send(argv[0])
-			} else {
-				msg, resperr = client.Send(argv[0], strings.Join(argv[1:], " "))
-			}
-
-			buf.WriteString("REPLY: " + msg + "\n")
-			if resperr != nil {
-				msg = resperr.Error()
-			}
-		}
-		mm.GetScreen().Show()
-	}
-
+	return client, nil
 }
@@ -0,0 +1,300 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	diamond "github.com/aerth/diamond/lib"
+)
+
+// target is one of many diamond sockets being controlled at once
+type target struct {
+	name   string
+	socket string
+	client *diamond.Client
+	status *diamond.Status
+	err    error
+}
+
+// sideSuffixes are added to a control socket path by the server, for the
+// runlevel 4 debug socket, a canary's control socket and the takeover lock
+var sideSuffixes = []string{".debug", ".canary", ".lock"}
+
+// resolveSockets expands a glob or a directory of sockets, multi is true
+// unless arg is the path of a single socket. In a directory, only control
+// sockets answering HELLO and STATUS are used, other sockets (such as
+// unix listeners) are skipped.
+func resolveSockets(arg string) (paths []string, multi bool, err error) {
+	if strings.ContainsAny(arg, "*?[") {
+		paths, err = filepath.Glob(arg)
+		if err != nil {
+			return nil, true, err
+		}
+		if len(paths) == 0 {
+			return nil, true, fmt.Errorf("no sockets match %q", arg)
+		}
+		return paths, true, nil
+	}
+	fi, err := os.Stat(arg)
+	if err != nil || !fi.IsDir() {
+		return []string{arg}, false, nil
+	}
+	files, err := ioutil.ReadDir(arg)
+	if err != nil {
+		return nil, true, err
+	}
+	for _, f := range files {
+		if f.Mode()&os.ModeSocket == 0 || sideSocket(f.Name()) != "" {
+			continue
+		}
+		if path := filepath.Join(arg, f.Name()); answers(path) {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, true, fmt.Errorf("no sockets in directory %q", arg)
+	}
+	return paths, true, nil
+}
+
+// sideSocket returns the suffix if name is one of sideSuffixes
+func sideSocket(name string) string {
+	for _, suffix := range sideSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return suffix
+		}
+	}
+	return ""
+}
+
+// answers is true if path is a control socket
+func answers(path string) bool {
+	client, err := dial(path)
+	if err == nil {
+		_, err = client.Status()
+	}
+	return err == nil
+}
+
+// socketName is the socket filename without extension, keeping a side
+// suffix ("web.sock.canary" is "web.canary") so it differs from the server's
+func socketName(path string) string {
+	base := filepath.Base(path)
+	suffix := sideSocket(base)
+	base = strings.TrimSuffix(base, suffix)
+	return strings.TrimSuffix(base, filepath.Ext(base)) + suffix
+}
+
+// buildTargets connects to each socket matching the -m and -l filters
+func buildTargets(paths []string) []*target {
+	var targets []*target
+	for _, path := range paths {
+		t := &target{name: socketName(path), socket: path}
+		if *match != "" {
+			if ok, _ := filepath.Match(*match, t.name); !ok {
+				continue
+			}
+		}
+		t.client, t.err = dial(path)
+		if t.err == nil {
+			t.status, t.err = t.client.Status()
+		}
+		if *level >= 0 && (t.status == nil || t.status.Level != *level) {
+			continue
+		}
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+// doFleet shows a table of all targets, or sends argv to each of them,
+// returning the exit code
+func doFleet(paths []string, argv []string) int {
+	targets := buildTargets(paths)
+	if len(targets) == 0 {
+		println("No sockets matched")
+		return 2
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if len(argv) == 0 {
+		printTable(w, targets)
+		w.Flush()
+		return 0
+	}
+
+	var failed int
+	fmt.Fprintln(w, "NAME\tRESULT\tREPLY")
+	for _, t := range targets {
+		var reply string
+		if t.err == nil {
+			reply, t.err = send(t.client, argv)
+		}
+		if t.err != nil {
+			failed++
+			fmt.Fprintf(w, "%s\tFAIL\t%v\n", t.name, t.err)
+			continue
+		}
+		fmt.Fprintf(w, "%s\tOK\t%s\n", t.name, oneline(reply))
+	}
+	w.Flush()
+	fmt.Printf("%d ok, %d failed\n", len(targets)-failed, failed)
+	if failed != 0 {
+		return 1
+	}
+	return 0
+}
+
+func printTable(w *tabwriter.Writer, targets []*target) {
+	fmt.Fprintln(w, "NAME\tLEVEL\tLISTENERS\tUPTIME\tPID\tROLE")
+	for _, t := range targets {
+		if t.err != nil {
+			// the error goes in the last column, where its length widens nothing
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t(%v)\n", t.name, t.err)
+			continue
+		}
+		st := t.status
+		role := formatRole(st)
+		if role == "" {
+			role = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d/%d\t%s\t%d\t%s\n", t.name, formatLevel(st),
+			st.Open, st.Listeners, st.Uptime.Round(time.Second), st.PID, role)
+	}
+}
+
+// send argv[0] as command, with the rest as arguments
+func send(client *diamond.Client, argv []string) (string, error) {
+	if argv[0] == cmdRedeploy {
+		return redeploy(client)
+	}
+	if argv[0] == cmdListeners {
+		return listeners(client)
+	}
+	if argv[0] == cmdHistory {
+		return transitions(client, argv[1:])
+	}
+	if argv[0] == cmdReload {
+		return reload(client, argv[1:])
+	}
+	if argv[0] == cmdRunlevels {
+		return runlevels(client)
+	}
+	if len(argv) < 2 {
+		return client.Send(argv[0])
+	}
+	return client.Send(argv[0], strings.Join(argv[1:], " "))
+}
+
+func oneline(s string) string {
+	return strings.Replace(strings.TrimSpace(s), "\n", " ", -1)
+}
+
+// listeners shows connection counters for each listener
+func listeners(client *diamond.Client) (string, error) {
+	st, err := client.Status()
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDR\tTYPE\tOPEN\tACTIVE\tIDLE\tCONNS\tACCEPTED\tCLOSED\tIN\tOUT")
+	for _, l := range st.Stats {
+		addr := l.Addr
+		if l.Name != "" {
+			addr = l.Name + " " + addr
+		}
+		fmt.Fprintf(w, "%s\t%s\t%v\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", addr, l.Type, l.Open,
+			l.Active, l.Idle, l.Conns, l.Accepted, l.Closed, l.BytesIn, l.BytesOut)
+	}
+	w.Flush()
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// reload applies listener definitions from a config file on the server
+// (argv[0]), or from where the server loaded them
+func reload(client *diamond.Client, argv []string) (string, error) {
+	r, err := client.Reload(strings.Join(argv, " "))
+	if err != nil {
+		return "", err
+	}
+	return "reloaded listeners: " + r.String(), nil
+}
+
+// runlevels shows the names of the server's runlevels
+func runlevels(client *diamond.Client) (string, error) {
+	names, err := client.Runlevels()
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "LEVEL\tNAME\tALIASES\tDESCRIPTION")
+	for _, r := range names {
+		aliases := strings.Join(r.Aliases, ",")
+		if aliases == "" {
+			aliases = "-"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", r.Level, r.Name, aliases, r.Description)
+	}
+	w.Flush()
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// transitions shows the last runlevel transitions (all kept, or argv[0])
+func transitions(client *diamond.Client, argv []string) (string, error) {
+	var n int
+	if len(argv) > 0 {
+		var err error
+		if n, err = strconv.Atoi(argv[0]); err != nil {
+			return "", fmt.Errorf("usage: history [N]")
+		}
+	}
+	history, err := client.History(n)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tFROM\tTO\tBY\tTOOK\tRESULT")
+	for _, t := range history {
+		result := t.Result
+		if t.Error != "" {
+			result += ": " + t.Error
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%v\t%s\n", t.Time.Format("2006-01-02 15:04:05"),
+			t.From, t.To, t.Requester, t.Took.Round(time.Microsecond), result)
+	}
+	w.Flush()
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
@@ -0,0 +1,80 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxHistory is how many commands are kept in the history file
+const maxHistory = 500
+
+// historyFile is $DIAMOND_HISTORY, or ~/.diamond_history
+func historyFile() string {
+	if f := os.Getenv("DIAMOND_HISTORY"); f != "" {
+		return f
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".diamond_history")
+}
+
+// loadHistory returns the commands saved from previous sessions
+func loadHistory() []string {
+	f, err := os.Open(historyFile())
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if n := len(lines) - maxHistory; n > 0 {
+		lines = lines[n:]
+	}
+	return lines
+}
+
+// saveHistory writes the most recent commands to the history file
+func saveHistory(lines []string) error {
+	name := historyFile()
+	if name == "" {
+		return nil
+	}
+	if n := len(lines) - maxHistory; n > 0 {
+		lines = lines[n:]
+	}
+	return ioutil.WriteFile(name, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
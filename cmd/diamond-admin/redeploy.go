@@ -0,0 +1,167 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	diamond "github.com/aerth/diamond/lib"
+)
+
+var (
+	redeploycmd = flag.String("redeploy", os.Getenv("DIAMOND_REDEPLOY"), "command (via sh -c) that starts the new binary, for the redeploy command")
+	rollbackcmd = flag.String("rollback", os.Getenv("DIAMOND_ROLLBACK"), "command (via sh -c) that restarts the old binary, if redeploy fails and the old process is gone or no longer owns the socket")
+)
+
+// redeploy runs the -redeploy command to start a new binary, which KICKs the
+// old process. It waits up to -t for the new process to answer HELLO in
+// runlevel 3, and rolls back if it doesn't.
+func redeploy(client *diamond.Client) (string, error) {
+	if *redeploycmd == "" {
+		return "", fmt.Errorf("no redeploy command, use -redeploy flag or DIAMOND_REDEPLOY")
+	}
+	old, err := client.Status()
+	if err != nil {
+		return "", fmt.Errorf("old process: %v", err)
+	}
+	socket := client.GetSocket()
+	cmd, logname, exited, err := start(*redeploycmd)
+	if err != nil {
+		return "", err
+	}
+	st, err := waitFor(socket, old.PID, exited)
+	if err == nil {
+		return fmt.Sprintf("redeployed: old pid %d, new pid %d", old.PID, st.PID), nil
+	}
+
+	// the new process didn't come up, stop it (and its children)
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	return "", fmt.Errorf("new process failed: %v (output in %s), %s", err, logname, rollback(socket, old))
+}
+
+// start runs command in its own session, so it outlives diamond-admin,
+// with output going to a temporary file
+func start(command string) (*exec.Cmd, string, chan error, error) {
+	logf, err := ioutil.TempFile("", "diamond-redeploy-")
+	if err != nil {
+		return nil, "", nil, err
+	}
+	defer logf.Close()
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout, cmd.Stderr = logf, logf
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, "", nil, err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	return cmd, logf.Name(), exited, nil
+}
+
+// waitFor a process other than oldpid to answer on the socket in runlevel 3.
+// A command exiting with an error (on exited) fails early.
+func waitFor(socket string, oldpid int, exited chan error) (*diamond.Status, error) {
+	deadline := time.Now().Add(*timeout)
+	var err error
+	for {
+		select {
+		case e := <-exited:
+			if e != nil {
+				return nil, fmt.Errorf("command exited: %v", e)
+			}
+			exited = nil // wrapper script is done, keep waiting
+		default:
+		}
+		var st *diamond.Status
+		var client *diamond.Client
+		if client, err = dial(socket); err == nil {
+			if st, err = client.Status(); err == nil {
+				switch {
+				case st.PID == oldpid:
+					err = fmt.Errorf("old process still running")
+				case st.Level != 3:
+					err = fmt.Errorf("new process %d in runlevel %d", st.PID, st.Level)
+				default:
+					return st, nil
+				}
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timeout after %s: %v", *timeout, err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// rollback re-raises the old process to runlevel 3 if it still owns the
+// socket, or runs the -rollback command if it is gone or no longer owns
+// the socket (it was kicked, or handed off)
+func rollback(socket string, old *diamond.Status) string {
+	alive := syscall.Kill(old.PID, 0) == nil
+	client, err := dial(socket)
+	var st *diamond.Status
+	if err == nil {
+		st, err = client.Status()
+	}
+	owner := err == nil && st.PID == old.PID
+	var why string
+	switch {
+	case alive && owner:
+		if st.Level == 3 {
+			return fmt.Sprintf("old pid %d still in runlevel 3", old.PID)
+		}
+		if _, err = client.Send("runlevel", "3"); err != nil {
+			return fmt.Sprintf("old pid %d owns the socket, but could not be re-raised: %v", old.PID, err)
+		}
+		return fmt.Sprintf("rolled back: old pid %d back in runlevel 3", old.PID)
+	case alive:
+		why = fmt.Sprintf("old pid %d is alive, but no longer owns the socket", old.PID)
+	default:
+		why = fmt.Sprintf("old pid %d is gone", old.PID)
+	}
+	if *rollbackcmd == "" {
+		return why + ", no -rollback command"
+	}
+
+	// whoever owned the socket was just stopped
+	if _, err := dial(socket); err != nil {
+		os.Remove(socket)
+	}
+	_, logname, exited, err := start(*rollbackcmd)
+	if err != nil {
+		return why + ", rollback failed: " + err.Error()
+	}
+	st, err = waitFor(socket, old.PID, exited)
+	if err != nil {
+		return fmt.Sprintf("%s, rollback failed: %v (output in %s)", why, err, logname)
+	}
+	return fmt.Sprintf("%s, rolled back: replaced by pid %d", why, st.PID)
+}
@@ -0,0 +1,186 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	rolling = flag.Bool("rolling", false, "move each socket from runlevel 3 to 1 and back to 3, a batch at a time")
+	batch   = flag.Int("n", 1, "number of sockets per batch when rolling")
+	probe   = flag.String("probe", "", "health check command to run (via sh -c) after each socket returns to runlevel 3")
+	timeout = flag.Duration("t", 30*time.Second, "time to wait for each socket to return to runlevel 3 and pass health check")
+)
+
+// doRolling cycles all targets through runlevel 1, stopping at the first
+// batch with a failure, returning the exit code
+func doRolling(paths []string) int {
+	targets := buildTargets(paths)
+	if len(targets) == 0 {
+		println("No sockets matched")
+		return 2
+	}
+	n := *batch
+	if n < 1 {
+		n = 1
+	}
+	results := make([]string, len(targets))
+	var failed, i int
+	for ; i < len(targets) && failed == 0; i += n {
+		end := i + n
+		if end > len(targets) {
+			end = len(targets)
+		}
+		var wg sync.WaitGroup
+		for j := i; j < end; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				if err := roll(targets[j]); err != nil {
+					targets[j].err = err
+				}
+			}(j)
+		}
+		wg.Wait()
+		for j := i; j < end; j++ {
+			if targets[j].err != nil {
+				failed++
+				results[j] = "FAIL"
+				continue
+			}
+			results[j] = "OK"
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tRESULT\tDETAIL")
+	for j, t := range targets {
+		switch {
+		case results[j] == "":
+			fmt.Fprintf(w, "%s\tSKIPPED\taborted\n", t.name)
+		case t.err != nil:
+			fmt.Fprintf(w, "%s\t%s\t%v\n", t.name, results[j], t.err)
+		default:
+			fmt.Fprintf(w, "%s\t%s\tpid %d\n", t.name, results[j], t.status.PID)
+		}
+	}
+	w.Flush()
+	if failed != 0 {
+		fmt.Printf("aborted: %d failed\n", failed)
+		return 1
+	}
+	fmt.Printf("%d ok\n", len(targets))
+	return 0
+}
+
+// roll moves one target 3→1→3, then waits for it to become healthy
+func roll(t *target) error {
+	if t.err != nil {
+		return t.err
+	}
+	if t.status.Level != 3 {
+		return fmt.Errorf("not in runlevel 3 (in %d)", t.status.Level)
+	}
+	for _, level := range []string{"1", "3"} {
+		fmt.Printf("%s: runlevel %s\n", t.name, level)
+		if _, err := t.client.Send("runlevel", level); err != nil {
+			return fmt.Errorf("runlevel %s: %v", level, err)
+		}
+	}
+	deadline := time.Now().Add(*timeout)
+	var err error
+	for {
+		if err = healthy(t, deadline); err == nil {
+			fmt.Printf("%s: healthy\n", t.name)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("unhealthy after %s: %v", *timeout, err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// healthy is true when the target is in runlevel 3 with all listeners
+// open, and the -probe command (if any) exits zero before deadline
+func healthy(t *target, deadline time.Time) error {
+	st, err := t.client.Status()
+	if err != nil {
+		return err
+	}
+	t.status = st
+	if st.Level != 3 {
+		return fmt.Errorf("in runlevel %d", st.Level)
+	}
+	if st.Open != st.Listeners {
+		return fmt.Errorf("%d/%d listeners open", st.Open, st.Listeners)
+	}
+	if *probe == "" {
+		return nil
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", *probe)
+	cmd.Env = append(os.Environ(),
+		"DIAMOND_SOCKET="+t.socket,
+		"DIAMOND_NAME="+t.name,
+		"DIAMOND_PID="+strconv.Itoa(st.PID),
+	)
+	// in its own process group, to kill whatever the probe started too
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("probe: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-exited:
+		}
+	}()
+	err = cmd.Wait()
+	close(exited)
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("probe: still running after %s", *timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("probe: %v: %s", err, oneline(out.String()))
+	}
+	return nil
+}
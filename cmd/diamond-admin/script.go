@@ -0,0 +1,167 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	diamond "github.com/aerth/diamond/lib"
+)
+
+var script = flag.String("f", "", "run commands from script file (- for stdin), stopping at the first failed step")
+
+// directives are script steps handled by diamond-admin, not sent to the server
+var directives = map[string]bool{"sleep": true, "wait-level": true, "wait-boot": true, "expect": true}
+
+// doScript runs a script of commands, one per line, returning the exit code.
+// Besides commands sent to the server, a script may contain directives:
+//
+//	sleep DURATION             pause, such as "sleep 5s"
+//	wait-level N [TIMEOUT]     wait until the server is in runlevel N, a number or name (default timeout -t)
+//	wait-boot [TIMEOUT]        wait until the server has booted, failing if its boot failed
+//	expect TEXT                the reply of the previous command must contain TEXT
+//
+// Blank lines and lines starting with # are skipped.
+func doScript(client *diamond.Client, name string) int {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			println(err.Error())
+			return 2
+		}
+		defer f.Close()
+		r = f
+	}
+	var reply string
+	var n int
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fmt.Printf("%s:%d: %s\n", name, n, line)
+		var err error
+		reply, err = step(client, line, reply)
+		if err != nil {
+			fmt.Printf("%s:%d: failed: %v\n", name, n, err)
+			return 1
+		}
+		if !directives[strings.Fields(line)[0]] && reply != "" {
+			fmt.Println(reply)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		println(err.Error())
+		return 2
+	}
+	return 0
+}
+
+// step runs one line of a script, returning the reply to be checked by expect
+func step(client *diamond.Client, line, last string) (string, error) {
+	argv := strings.Fields(line)
+	switch argv[0] {
+	case "sleep":
+		if len(argv) != 2 {
+			return "", fmt.Errorf("usage: sleep DURATION")
+		}
+		d, err := parseDuration(argv[1])
+		if err != nil {
+			return "", err
+		}
+		time.Sleep(d)
+		return last, nil
+	case "wait-level":
+		if len(argv) < 2 || len(argv) > 3 {
+			return "", fmt.Errorf("usage: wait-level N [TIMEOUT]")
+		}
+		level, err := client.ParseRunlevel(argv[1])
+		if err != nil {
+			return "", err
+		}
+		wait := *timeout
+		if len(argv) == 3 {
+			if wait, err = parseDuration(argv[2]); err != nil {
+				return "", err
+			}
+		}
+		return last, waitLevel(client, level, wait)
+	case "wait-boot":
+		if len(argv) > 2 {
+			return "", fmt.Errorf("usage: wait-boot [TIMEOUT]")
+		}
+		wait := *timeout
+		if len(argv) == 2 {
+			var err error
+			if wait, err = parseDuration(argv[1]); err != nil {
+				return "", err
+			}
+		}
+		return last, client.WaitBoot(wait)
+	case "expect":
+		want := strings.TrimSpace(strings.TrimPrefix(line, "expect"))
+		if !strings.Contains(last, want) {
+			return "", fmt.Errorf("expected %q, got %q", want, last)
+		}
+		return last, nil
+	}
+	return send(client, argv)
+}
+
+// waitLevel polls the server until it is in runlevel level
+func waitLevel(client *diamond.Client, level int, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	for {
+		st, err := client.Status()
+		if err == nil && st.Level == level {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("timeout after %s: %v", wait, err)
+			}
+			return fmt.Errorf("timeout after %s, in runlevel %d", wait, st.Level)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// parseDuration allows plain seconds, such as "5", as well as "5s"
+func parseDuration(s string) (time.Duration, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		return time.Duration(n) * time.Second, nil
+	}
+	return time.ParseDuration(s)
+}
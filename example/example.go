@@ -9,26 +9,11 @@ import (
 	"fmt"
 	"net/http"
 	"os"
-	"os/signal"
-	"syscall"
 	"time"
 
 	diamond "github.com/aerth/diamond/lib"
 )
 
-func catchSignals(s *diamond.System) {
-	go func(srv *diamond.System) {
-		c := make(chan os.Signal)
-		signal.Notify(c, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT)
-		select {
-		case s := <-c:
-			println("caught signal:", s.String())
-			srv.Runlevel(0)
-			os.Exit(0)
-		}
-	}(s)
-}
-
 func runlevel0() error {
 	fmt.Println(time.Now(), "demo runlevel 0\ngoodbye!")
 	go func() {
@@ -73,7 +58,7 @@ func main() {
 	}
 
 	// setup
-	catchSignals(srv)
+	srv.DefaultSignals() // SIGINT, SIGTERM: runlevel 0, SIGHUP: restart, or reload listeners
 	srv.Config.Verbose = true
 	srv.Config.Kickable = true
 	srv.SetRunlevel(0, runlevel0)
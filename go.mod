@@ -3,8 +3,7 @@ module github.com/aerth/diamond
 go 1.13
 
 require (
-	github.com/aerth/clix v0.0.0-20170409181627-55c1fd884c40
-	github.com/gdamore/tcell v1.3.0 // indirect
-	github.com/stretchr/testify v1.5.1 // indirect
+	github.com/BurntSushi/toml v0.3.0
+	github.com/gdamore/tcell v1.3.0
 	github.com/tv42/httpunix v0.0.0-20191220191345-2ba4b9c3382c
 )
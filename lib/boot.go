@@ -0,0 +1,206 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Boot states, as in Status.Boot
+const (
+	Booting    = "booting"
+	Booted     = "booted"
+	BootFailed = "failed"
+)
+
+// BootStep is one runlevel of Options.BootSequence
+type BootStep struct {
+	Level int
+
+	// Check runs once in Level, before the next step. An error fails the
+	// boot, leaving the system in Level.
+	Check func() error
+}
+
+// bootState is the progress of Boot
+type bootState struct {
+	mu     sync.Mutex
+	state  string // "" until Boot, then Booting, Booted or BootFailed
+	target int
+	err    error
+	done   chan struct{} // closed once booted or failed
+}
+
+// bootSteps is Options.BootSequence, ending in Options.BootTarget
+func (s *System) bootSteps() ([]BootStep, error) {
+	steps := append([]BootStep(nil), s.Config.BootSequence...)
+	target := s.Config.BootTarget
+	if len(steps) == 0 {
+		if target == 0 {
+			return nil, fmt.Errorf("no boot target or sequence in options")
+		}
+		steps = append(steps, BootStep{Level: 1})
+	}
+	if target != 0 && steps[len(steps)-1].Level != target {
+		steps = append(steps, BootStep{Level: target})
+	}
+	return steps, nil
+}
+
+// Boot enters each runlevel of Options.BootSequence in turn (default 1),
+// ending in Options.BootTarget, in the background. Until it is done,
+// Status shows Booting. WaitBoot returns the result.
+//
+//	s.Config.BootTarget = 3
+//	s.Config.BootSequence = []diamond.BootStep{{Level: 1}, {Level: 2, Check: db.Ping}}
+//	if err := s.Boot(); err != nil {
+//		log.Fatalln(err)
+//	}
+//	if err := s.WaitBoot(); err != nil {
+//		log.Fatalln(err)
+//	}
+func (s *System) Boot() error {
+	steps, err := s.bootSteps()
+	if err != nil {
+		return err
+	}
+	s.boot.mu.Lock()
+	defer s.boot.mu.Unlock()
+	if s.boot.state == Booting {
+		return fmt.Errorf("already booting to runlevel %d", s.boot.target)
+	}
+	s.boot.state = Booting
+	s.boot.target = steps[len(steps)-1].Level
+	s.boot.err = nil
+	s.boot.done = make(chan struct{})
+	s.event("booting to runlevel %d", s.boot.target)
+	go s.runBoot(steps)
+	return nil
+}
+
+func (s *System) runBoot(steps []BootStep) {
+	var err error
+	for _, step := range steps {
+		if !s.inRunlevel(step.Level) {
+			if err = s.RunlevelBy(step.Level, "boot"); err != nil {
+				break
+			}
+		}
+		if step.Check != nil {
+			if err = step.Check(); err != nil {
+				err = fmt.Errorf("boot check in runlevel %d: %v", step.Level, err)
+				break
+			}
+		}
+	}
+	s.boot.mu.Lock()
+	defer s.boot.mu.Unlock()
+	s.boot.err = err
+	if err != nil {
+		s.boot.state = BootFailed
+		s.event("boot failed: %v", err)
+	} else {
+		s.boot.state = Booted
+		s.event("booted to runlevel %d", s.boot.target)
+	}
+	close(s.boot.done)
+}
+
+// inRunlevel is true if level was entered, and not left since
+func (s *System) inRunlevel(level int) bool {
+	s.locklevel.Lock()
+	defer s.locklevel.Unlock()
+	return s.entered && s.level == level
+}
+
+// WaitBoot waits until Boot is done, returning its error
+func (s *System) WaitBoot() error {
+	return s.WaitBootTimeout(0)
+}
+
+// WaitBootTimeout is WaitBoot, giving up after timeout (0 for never)
+func (s *System) WaitBootTimeout(timeout time.Duration) error {
+	s.boot.mu.Lock()
+	done := s.boot.done
+	s.boot.mu.Unlock()
+	if done == nil {
+		return fmt.Errorf("not booting, see Boot")
+	}
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		select {
+		case <-done:
+		case <-t.C:
+			return fmt.Errorf("still booting after %v", timeout)
+		}
+	}
+	<-done
+	s.boot.mu.Lock()
+	defer s.boot.mu.Unlock()
+	return s.boot.err
+}
+
+// bootStatus fills in the boot fields of st
+func (s *System) bootStatus(st *Status) {
+	s.boot.mu.Lock()
+	defer s.boot.mu.Unlock()
+	st.Boot = s.boot.state
+	if s.boot.state != "" {
+		st.BootTarget = s.boot.target
+	}
+	if s.boot.err != nil {
+		st.BootError = s.boot.err.Error()
+	}
+}
+
+// WaitBoot polls the server until it has booted (see System.Boot),
+// returning an error if the boot failed or timeout passed first
+func (c *Client) WaitBoot(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		st, err := c.Status()
+		if err == nil {
+			switch st.Boot {
+			case Booted:
+				return nil
+			case BootFailed:
+				return fmt.Errorf("boot failed: %s", st.BootError)
+			}
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("timeout after %s: %v", timeout, err)
+			}
+			if st.Boot == "" {
+				return fmt.Errorf("timeout after %s, not booting", timeout)
+			}
+			return fmt.Errorf("timeout after %s, booting in runlevel %d", timeout, st.Level)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
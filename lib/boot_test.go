@@ -0,0 +1,171 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBoot(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	srv.SetHandler(foohandler)
+	srv.AddListener("tcp", "127.0.0.1:30125")
+	if err := srv.WaitBoot(); err == nil {
+		t.Log("expected error waiting before Boot")
+		t.FailNow()
+	}
+	if err := srv.Boot(); err == nil {
+		t.Log("expected error booting without a target")
+		t.FailNow()
+	}
+	checked := make(chan struct{})
+	srv.SetRunlevel(2, func() error { return nil })
+	srv.Config.BootTarget = 3
+	srv.Config.BootSequence = []BootStep{{Level: 1}, {Level: 2, Check: func() error {
+		<-checked
+		return nil
+	}}}
+	if err := srv.Boot(); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer srv.Runlevel(1)
+	if err := srv.Boot(); err == nil {
+		t.Log("expected error booting twice at once")
+		t.FailNow()
+	}
+	client, err := NewClient(socket)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	time.Sleep(100 * time.Millisecond)
+	st, err := client.Status()
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if st.Boot != Booting || st.BootTarget != 3 || st.Level != 2 {
+		t.Logf("expected booting to 3 in runlevel 2, got %q %d %d", st.Boot, st.BootTarget, st.Level)
+		t.FailNow()
+	}
+	if err := srv.WaitBootTimeout(50 * time.Millisecond); err == nil {
+		t.Log("expected timeout while the check waits")
+		t.FailNow()
+	}
+	close(checked)
+	if err := srv.WaitBoot(); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if err := client.WaitBoot(time.Second); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	testGet(t, "127.0.0.1:30125")
+	var steps []string
+	for _, tr := range srv.History(0) {
+		if tr.Requester != "boot" || tr.Result != "ok" {
+			t.Logf("unexpected transition %v", tr)
+			t.FailNow()
+		}
+		steps = append(steps, fmt.Sprintf("%d-%d", tr.From, tr.To))
+	}
+	if got := strings.Join(steps, " "); got != "0-1 1-2 2-3" {
+		t.Logf("expected boot through 1 and 2, got %s", got)
+		t.FailNow()
+	}
+}
+
+func TestBootFailed(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	srv.Config.BootTarget = 3
+	srv.Config.BootSequence = []BootStep{{Level: 1, Check: func() error { return fmt.Errorf("no database") }}}
+	if err := srv.Boot(); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	err := srv.WaitBoot()
+	if err == nil || err.Error() != "boot check in runlevel 1: no database" {
+		t.Logf("expected failed check, got %v", err)
+		t.FailNow()
+	}
+	client, err := NewClient(socket)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if err := client.WaitBoot(time.Second); err == nil || !strings.Contains(err.Error(), "no database") {
+		t.Logf("expected boot failure over the control socket, got %v", err)
+		t.FailNow()
+	}
+	if st := srv.Status(); st.Boot != BootFailed || st.Level != 1 {
+		t.Logf("expected failed boot in runlevel 1, got %q in %d", st.Boot, st.Level)
+		t.FailNow()
+	}
+
+	// booting again carries on from runlevel 1
+	srv.Config.BootSequence = nil
+	if err := srv.Boot(); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if err := srv.WaitBoot(); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if level := srv.GetRunlevel(); level != 3 {
+		t.Logf("expected runlevel 3, got %d", level)
+		t.FailNow()
+	}
+	srv.Runlevel(1)
+}
+
+func TestRunlevelZeroFromStart(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	if err := srv.Runlevel(0); err != nil {
+		t.Logf("expected a new system to shut down, got %v", err)
+		t.FailNow()
+	}
+	if code := srv.Wait(); code != 0 {
+		t.Logf("expected exit code 0, got %d", code)
+		t.FailNow()
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Logf("expected socket to be removed, got %v", err)
+		t.FailNow()
+	}
+	if err := srv.Runlevel(0); err == nil {
+		t.Log("expected error, already in runlevel 0")
+		t.FailNow()
+	}
+}
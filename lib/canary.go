@@ -0,0 +1,368 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CanaryEnv is set to the incumbent's pid and a one-time PROMOTE token
+// ("pid:token") for a canary started by StartCanary
+const CanaryEnv = "DIAMOND_CANARY"
+
+// DefaultCanaryPeriod is used when StartCanary is given no period
+var DefaultCanaryPeriod = 10 * time.Minute
+
+// canarySuffix is added to the control socket path of a canary
+const canarySuffix = ".canary"
+
+// canary is a process started by StartCanary, sharing our listeners
+type canary struct {
+	pid     int
+	socket  string
+	token   string // expected by the canary with PROMOTE
+	process *os.Process
+	until   time.Time
+	timer   *time.Timer   // promotes the canary at until
+	done    chan struct{} // closed when the process exits
+}
+
+// StartCanary starts a new binary (path, or the running executable if
+// empty) with the same arguments, sharing all open listeners, so both
+// processes accept connections in runlevel 3. The canary has its own
+// control socket (this one + ".canary"). After period (default
+// DefaultCanaryPeriod), or with PromoteCanary, the canary takes over the
+// control socket and this process drains and shifts to runlevel 0, as in
+// Upgrade. AbortCanary stops the canary instead.
+func (s *System) StartCanary(path string, period time.Duration) (pid int, err error) {
+	return s.startCanary(path, os.Args[1:], period)
+}
+
+func (s *System) startCanary(path string, args []string, period time.Duration) (pid int, err error) {
+	s.canarymu.Lock()
+	defer s.canarymu.Unlock()
+	if s.canary != nil {
+		return 0, fmt.Errorf("canary already running (pid %d)", s.canary.pid)
+	}
+	if period <= 0 {
+		period = DefaultCanaryPeriod
+	}
+	if path == "" {
+		if path, err = os.Executable(); err != nil {
+			return 0, err
+		}
+	}
+
+	s.locklevel.Lock()
+	if s.incumbent != 0 {
+		s.locklevel.Unlock()
+		return 0, fmt.Errorf("this is a canary, it can't start another")
+	}
+	token, err := promoteToken()
+	if err != nil {
+		s.locklevel.Unlock()
+		return 0, err
+	}
+	files, fds, dups, err := s.upgradeFiles(true)
+	if err == nil && len(files) == 0 {
+		err = fmt.Errorf("no open listeners to share")
+	}
+	if err != nil {
+		s.locklevel.Unlock()
+		return 0, err
+	}
+	cmd, exited, err := spawn(path, args, files, fds, CanaryEnv+"="+strconv.Itoa(os.Getpid())+":"+token)
+	s.locklevel.Unlock()
+	closeFiles(dups)
+	if err != nil {
+		return 0, err
+	}
+	c := &canary{
+		pid:     cmd.Process.Pid,
+		socket:  s.controlSocket + canarySuffix,
+		token:   token,
+		process: cmd.Process,
+		until:   time.Now().Add(period),
+		done:    make(chan struct{}),
+	}
+	s.event("starting canary %s (pid %d)", path, c.pid)
+	if err := waitServing(c.socket, c.pid, exited, UpgradeTimeout); err != nil {
+		cmd.Process.Kill()
+		s.event("canary failed: %v", err)
+		return 0, err
+	}
+	go s.watchCanary(c, exited)
+	c.timer = time.AfterFunc(period, func() {
+		if err := s.PromoteCanary(); err != nil {
+			s.event("canary not promoted: %v", err)
+		}
+	})
+	s.setCanary(c)
+	s.event("canary pid %d sharing listeners until %s", c.pid, c.until.Format("15:04:05"))
+	return c.pid, nil
+}
+
+// watchCanary forgets the canary when it exits
+func (s *System) watchCanary(c *canary, exited chan error) {
+	err := <-exited
+	close(c.done)
+	s.canarymu.Lock()
+	defer s.canarymu.Unlock()
+	if s.canary == c {
+		s.setCanary(nil)
+		c.timer.Stop()
+		s.event("canary pid %d exited: %v", c.pid, err)
+	}
+}
+
+// PromoteCanary completes a canary started by StartCanary: the canary
+// takes over the control socket, and this process drains and shifts to
+// runlevel 0
+func (s *System) PromoteCanary() error {
+	s.canarymu.Lock()
+	defer s.canarymu.Unlock()
+	c := s.canary
+	if c == nil {
+		return fmt.Errorf("no canary")
+	}
+	c.timer.Stop()
+	s.setCanary(nil)
+
+	// the canary locks its own pid file
+	s.locklevel.Lock()
+	locked := s.pidfile != nil
+	s.removePIDFile()
+	s.locklevel.Unlock()
+	if _, err := call(c.socket, "PROMOTE", c.token); err != nil && !s.promoted(c) {
+		if locked {
+			s.LockPIDFile()
+		}
+		s.event("could not promote canary pid %d: %v", c.pid, err)
+		s.abortCanary(c)
+		return err
+	}
+	s.event("promoted canary pid %d", c.pid)
+	if e := sdNotify("MAINPID=" + strconv.Itoa(c.pid)); e != nil {
+		s.log(LevelWarn, "error notifying service manager", FieldError, e)
+	}
+	go s.handoff()
+	return nil
+}
+
+// promoted is true if the canary has already taken over the control
+// socket, as when the reply to PROMOTE was lost
+func (s *System) promoted(c *canary) bool {
+	if _, err := os.Stat(c.socket); !os.IsNotExist(err) {
+		return false
+	}
+	reply, err := call(strings.TrimSuffix(c.socket, canarySuffix), "STATUS", "")
+	var st Status
+	if err != nil || json.Unmarshal([]byte(reply), &st) != nil {
+		return false
+	}
+	return st.PID == c.pid
+}
+
+// AbortCanary stops a canary started by StartCanary
+func (s *System) AbortCanary() error {
+	s.canarymu.Lock()
+	defer s.canarymu.Unlock()
+	c := s.canary
+	if c == nil {
+		return fmt.Errorf("no canary")
+	}
+	c.timer.Stop()
+	s.setCanary(nil)
+	s.abortCanary(c)
+	return nil
+}
+
+// abortCanary closes the canary's listeners first, so no connections are
+// lost, then stops it (killing it after the drain timeout)
+func (s *System) abortCanary(c *canary) {
+	call(c.socket, "Runlevel", "1")
+	call(c.socket, "Runlevel", "0")
+	select {
+	case <-c.done:
+	case <-time.After(s.drainTimeout()):
+		c.process.Kill()
+		<-c.done
+	}
+	s.event("aborted canary pid %d", c.pid)
+}
+
+// canaryOf returns the incumbent's pid and the PROMOTE token from
+// CanaryEnv, if this is a canary
+func canaryOf() (pid int, token string) {
+	defer os.Unsetenv(CanaryEnv)
+	f := strings.SplitN(os.Getenv(CanaryEnv), ":", 2)
+	if len(f) != 2 || f[1] == "" {
+		return 0, ""
+	}
+	pid, _ = strconv.Atoi(f[0])
+	return pid, f[1]
+}
+
+// promoteToken returns a new random token for CanaryEnv
+func promoteToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// promote takes over the incumbent's control socket, as a canary. The
+// incumbent drains and stops, and the listeners are ours. Only the
+// incumbent knows the token, from CanaryEnv.
+func (s *System) promote(token string) error {
+	s.locklevel.Lock()
+	if s.incumbent == 0 {
+		s.locklevel.Unlock()
+		return fmt.Errorf("not a canary")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.promoteToken)) != 1 {
+		s.locklevel.Unlock()
+		return fmt.Errorf("bad token")
+	}
+	socket := strings.TrimSuffix(s.controlSocket, canarySuffix)
+	if err := os.Rename(s.controlSocket, socket); err != nil {
+		s.locklevel.Unlock()
+		return err
+	}
+	if l, ok := s.controlListener.(*net.UnixListener); ok {
+		l.SetUnlinkOnClose(false) // removed by path in runlevel 0
+	}
+	s.controlSocket = socket
+	for _, l := range s.listeners {
+		l.borrowed = false
+	}
+	incumbent := s.incumbent
+	s.incumbent, s.promoteToken = 0, ""
+	pidfile := s.pidfile != nil
+	s.removePIDFile() // next to the canary socket
+	s.locklevel.Unlock()
+	s.event("promoted, taking over from pid %d on %s", incumbent, socket)
+	if pidfile {
+		if err := s.LockPIDFile(); err != nil {
+			s.event("could not lock pid file: %v", err)
+		}
+	}
+	return nil
+}
+
+// setCanary sets s.canary, and the copy read by canaryStatus.
+// Caller holds canarymu.
+func (s *System) setCanary(c *canary) {
+	s.canary = c
+	s.canaryView.Store(c)
+}
+
+// canaryStatus fills in Role, Peer, PeerSocket and CanaryUntil. It never
+// waits for canarymu, held while a canary starts or stops.
+func (s *System) canaryStatus(st *Status) {
+	if c, _ := s.canaryView.Load().(*canary); c != nil {
+		st.Role, st.Peer, st.PeerSocket, st.CanaryUntil = "incumbent", c.pid, c.socket, c.until
+	}
+}
+
+// Canary starts, promotes or aborts a canary:
+// CANARY start [period [path]], CANARY promote or CANARY abort.
+// A canary takes over like KICK does, so all three are refused the same way.
+func (p *packet) Canary(arg string, reply *string) error {
+	p.parent.event("CANARY %s %s", arg, p.peer)
+	if err := p.parent.refuseKick(p.peer); err != nil {
+		p.parent.event("refused CANARY: %v", err)
+		*reply = "NOWAY"
+		return fmt.Errorf("NOWAY: %v", err)
+	}
+	f := strings.Fields(arg)
+	if len(f) == 0 || len(f) > 3 {
+		*reply = "error"
+		return fmt.Errorf("usage: CANARY start [period [path]] | promote | abort")
+	}
+	var err error
+	switch strings.ToLower(f[0]) {
+	case "start":
+		var period time.Duration
+		var path string
+		if len(f) > 1 {
+			if period, err = time.ParseDuration(f[1]); err != nil {
+				*reply = "error"
+				return err
+			}
+		}
+		if len(f) > 2 {
+			path = f[2]
+		}
+		var pid int
+		if pid, err = p.parent.StartCanary(path, period); err == nil {
+			*reply = "OKAY " + strconv.Itoa(pid)
+			return nil
+		}
+	case "promote":
+		err = p.parent.PromoteCanary()
+	case "abort":
+		err = p.parent.AbortCanary()
+	default:
+		err = fmt.Errorf("unknown CANARY command %q", f[0])
+	}
+	if err != nil {
+		*reply = "error"
+		return err
+	}
+	*reply = "OKAY"
+	return nil
+}
+
+func (p *packet) CANARY(arg string, reply *string) error {
+	return p.Canary(arg, reply)
+}
+
+// Promote is sent to a canary by the incumbent, with the token from
+// CanaryEnv, see PromoteCanary
+func (p *packet) Promote(arg string, reply *string) error {
+	p.parent.event("PROMOTE")
+	if err := p.parent.promote(arg); err != nil {
+		p.parent.event("refused PROMOTE: %v", err)
+		*reply = "error"
+		return err
+	}
+	*reply = "OKAY"
+	return nil
+}
+
+func (p *packet) PROMOTE(arg string, reply *string) error {
+	return p.Promote(arg, reply)
+}
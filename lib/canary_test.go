@@ -0,0 +1,268 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCanaryChild is the canary started by TestCanary*
+func TestCanaryChild(t *testing.T) {
+	if os.Getenv(CanaryEnv) == "" {
+		t.Skip("only run by TestCanary")
+	}
+	srv, err := New(os.Getenv("DIAMOND_TEST_SOCKET"))
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	srv.SetHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "canary %d\n", os.Getpid())
+	}))
+	srv.AddListener("tcp", os.Getenv("DIAMOND_TEST_ADDR"))
+	if err := srv.Runlevel(3); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	srv.Wait()
+}
+
+// startTestCanary starts an incumbent serving foohandler on addr, and a canary
+func startTestCanary(t *testing.T, addr string) (*System, string, int) {
+	socket := tempSocket(t)
+	srv, err := New(socket)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	srv.SetHandler(foohandler)
+	srv.AddListener("tcp", addr)
+	if err := srv.Runlevel(3); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	os.Setenv("DIAMOND_TEST_SOCKET", socket)
+	os.Setenv("DIAMOND_TEST_ADDR", addr)
+	defer os.Unsetenv("DIAMOND_TEST_SOCKET")
+	defer os.Unsetenv("DIAMOND_TEST_ADDR")
+	pid, err := srv.startCanary(os.Args[0], []string{"-test.run=^TestCanaryChild$"}, time.Hour)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	return srv, socket, pid
+}
+
+// served counts responses from the incumbent and the canary
+func served(t *testing.T, addr string, n int) (incumbent, canary int) {
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for i := 0; i < n; i++ {
+		resp, err := client.Get("http://" + addr + "/")
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if strings.HasPrefix(string(b), "canary") {
+			canary++
+		} else {
+			incumbent++
+		}
+	}
+	return incumbent, canary
+}
+
+func statusOf(t *testing.T, socket string) *Status {
+	client, err := NewClient(socket)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	st, err := client.Status()
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	return st
+}
+
+func TestCanaryPromote(t *testing.T) {
+	addr := "127.0.0.1:30106"
+	srv, socket, pid := startTestCanary(t, addr)
+	defer os.Remove(socket)
+
+	st := statusOf(t, socket)
+	if st.Role != "incumbent" || st.Peer != pid || st.PeerSocket != socket+canarySuffix {
+		t.Logf("unexpected incumbent status: %+v", st)
+		t.FailNow()
+	}
+	st = statusOf(t, socket+canarySuffix)
+	if st.Role != "canary" || st.Peer != os.Getpid() || st.PID != pid || st.Level != 3 {
+		t.Logf("unexpected canary status: %+v", st)
+		t.FailNow()
+	}
+	if incumbent, canary := served(t, addr, 200); incumbent == 0 || canary == 0 {
+		t.Logf("wanted both to serve, got incumbent %d, canary %d", incumbent, canary)
+		t.FailNow()
+	}
+
+	if err := srv.PromoteCanary(); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	select {
+	case <-wait(srv):
+	case <-time.After(5 * time.Second):
+		t.Log("incumbent did not reach runlevel 0")
+		t.FailNow()
+	}
+	st = statusOf(t, socket)
+	if st.PID != pid || st.Role != "" {
+		t.Logf("expected promoted canary on socket, got %+v", st)
+		t.FailNow()
+	}
+	if incumbent, _ := served(t, addr, 20); incumbent != 0 {
+		t.Log("incumbent still serving after promote")
+		t.FailNow()
+	}
+	call(socket, "Runlevel", "0")
+}
+
+func TestCanaryAbort(t *testing.T) {
+	addr := "127.0.0.1:30107"
+	srv, socket, _ := startTestCanary(t, addr)
+	defer os.Remove(socket)
+	defer srv.Runlevel(1)
+	if err := srv.AbortCanary(); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if _, err := os.Stat(socket + canarySuffix); !os.IsNotExist(err) {
+		t.Log("wanted canary socket removed, got:", err)
+		t.FailNow()
+	}
+	if st := statusOf(t, socket); st.Role != "" || st.Level != 3 {
+		t.Logf("expected incumbent alone in runlevel 3, got %+v", st)
+		t.FailNow()
+	}
+	if _, canary := served(t, addr, 20); canary != 0 {
+		t.Log("canary still serving after abort")
+		t.FailNow()
+	}
+}
+
+func TestCanaryStatusNotBlocked(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	// as while a canary starts, or drains when aborted
+	srv.canarymu.Lock()
+	defer srv.canarymu.Unlock()
+	done := make(chan Status, 1)
+	go func() { done <- srv.Status() }()
+	select {
+	case st := <-done:
+		if st.Role != "" {
+			t.Logf("expected no role without a canary, got %q", st.Role)
+			t.FailNow()
+		}
+	case <-time.After(time.Second):
+		t.Log("Status waited for the canary lock")
+		t.FailNow()
+	}
+}
+
+func TestCanaryRefused(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	token := tokenFile(t, "s3cret")
+	defer os.Remove(token)
+	client, err := NewClient(socket)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	for _, arg := range []string{"start 1h /bin/false", "promote", "abort"} {
+		if _, err := client.Send("canary", arg); err == nil || !strings.Contains(err.Error(), "not kickable") {
+			t.Logf("expected canary %s refused when not kickable, got %v", arg, err)
+			t.FailNow()
+		}
+	}
+	srv.Config.Kickable = true
+	srv.Config.KickTokenFile = token
+	if _, err := client.Send("canary", "start 1h /bin/false"); err == nil || !strings.Contains(err.Error(), "bad token") {
+		t.Logf("expected canary refused without token, got %v", err)
+		t.FailNow()
+	}
+	client.Token = "s3cret"
+	if _, err := client.Send("canary", "abort"); err == nil || !strings.Contains(err.Error(), "no canary") {
+		t.Logf("expected canary abort allowed with token, got %v", err)
+		t.FailNow()
+	}
+}
+
+func TestCanaryPromoteToken(t *testing.T) {
+	addr := "127.0.0.1:30128"
+	srv, socket, pid := startTestCanary(t, addr)
+	defer os.Remove(socket)
+
+	// only the incumbent may promote the canary
+	if _, err := call(socket+canarySuffix, "PROMOTE", ""); err == nil || !strings.Contains(err.Error(), "bad token") {
+		t.Logf("expected PROMOTE without token refused, got %v", err)
+		t.FailNow()
+	}
+	if st := statusOf(t, socket); st.PID != os.Getpid() || st.Role != "incumbent" {
+		t.Logf("expected incumbent still on socket, got %+v", st)
+		t.FailNow()
+	}
+
+	// promoted, but the reply was lost: the canary is kept
+	token := srv.canary.token
+	if _, err := call(socket+canarySuffix, "PROMOTE", token); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if err := srv.PromoteCanary(); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	select {
+	case <-wait(srv):
+	case <-time.After(5 * time.Second):
+		t.Log("incumbent did not reach runlevel 0")
+		t.FailNow()
+	}
+	if st := statusOf(t, socket); st.PID != pid || st.Level != 3 {
+		t.Logf("expected promoted canary on socket, got %+v", st)
+		t.FailNow()
+	}
+	call(socket, "Runlevel", "0")
+}
@@ -35,6 +35,7 @@ type Client struct {
 	socket     string        // path to socket file
 	ServerName string        // gets filled in with rpc, optional.
 	Name       string        // optional, can be sent to identify the admin
+	Token      string        // optional, sent in HELLO before each command (see Options.KickTokenFile)
 	serveraddr *net.UnixAddr // gets parsed from path in NewClient(path)
 }
 
@@ -67,6 +68,14 @@ func (c *Client) Send(cmd string, args ...string) (reply string, err error) {
 	if err != nil {
 		return "", err
 	}
+	defer client.Close()
+	if c.Token != "" {
+		// introduce ourselves on this connection
+		var r string
+		if err := client.Call("Diamond.HELLO", helloArg(c.Name, c.Token), &r); err != nil {
+			return "", err
+		}
+	}
 	if !strings.Contains(cmd, ".") {
 		cmd = "Diamond." + strings.Title(cmd)
 	}
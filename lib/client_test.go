@@ -63,7 +63,8 @@ func TestClient(t *testing.T) {
 		reply, err := client.Send("echo", "hello world")
 		if err != nil {
 			t.Logf("tried to send command, got error: %v", err)
-			t.FailNow()
+			t.Fail()
+			return
 		}
 		c <- reply
 	}(t)
@@ -104,7 +105,8 @@ func TestClientRunlevel(t *testing.T) {
 		reply, err := client.Send("runlevel", "1")
 		if err != nil {
 			t.Logf("tried to send command, got error: %v", err)
-			t.FailNow()
+			t.Fail()
+			return
 		}
 		c <- reply
 	}(t)
@@ -146,7 +148,8 @@ func TestClientKick(t *testing.T) {
 		reply, err := client.Send("KICK")
 		if err != nil {
 			t.Logf("tried to send command, got error: %v", err)
-			t.FailNow()
+			t.Fail()
+			return
 		}
 		c <- reply
 	}(t)
@@ -166,3 +169,47 @@ func TestClientKick(t *testing.T) {
 	println("kicked!")
 
 }
+
+func TestClientStatus(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	if _, err := srv.AddListener("tcp", "127.0.0.1:30100"); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if err := srv.Runlevel(3); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer srv.Runlevel(1)
+
+	client, err := NewClient(socket)
+	if err != nil {
+		t.Logf("tried to create client, got error: %v", err)
+		t.FailNow()
+	}
+	st, err := client.Status()
+	if err != nil {
+		t.Logf("tried to get status, got error: %v", err)
+		t.FailNow()
+	}
+	if st.Level != 3 || st.Listeners != 1 || st.Open != 1 {
+		t.Logf("wanted level 3 with 1/1 listeners open, got: %+v", st)
+		t.FailNow()
+	}
+	if st.PID != os.Getpid() || st.Socket != socket {
+		t.Logf("wrong pid or socket: %+v", st)
+		t.FailNow()
+	}
+
+	srv.Runlevel(1)
+	st, err = client.Status()
+	if err != nil {
+		t.Logf("tried to get status, got error: %v", err)
+		t.FailNow()
+	}
+	if st.Level != 1 || st.Open != 0 {
+		t.Logf("wanted level 1 with 0 listeners open, got: %+v", st)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,464 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Config describes a System, as read from a file by LoadConfig
+type Config struct {
+	Socket     string      // control socket path
+	SocketMode os.FileMode // permissions of the control socket, if not CHMODFILE
+	PIDFile    bool        // see LockPIDFile
+	Options    Options
+	Listeners  []ListenerConfig
+	Metrics    *ListenerConfig // see ServeMetrics
+	Runlevel   int             // to enter once the program is ready (default 3)
+
+	path string // read by LoadConfig, again by ReloadListeners
+}
+
+// ListenerConfig is a listener in a Config
+type ListenerConfig struct {
+	Name string // optional, see AddNamedListener
+	Type string // "tcp" (default), "unix" or "tls"
+	Addr string
+	Cert string // certificate and key files, for "tls"
+	Key  string
+}
+
+// ConfigError is a problem with a config file, at a key such as "listeners[1].addr"
+type ConfigError struct {
+	File string
+	Key  string // empty if the file could not be read or parsed
+	Err  string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Key == "" {
+		return e.File + ": " + e.Err
+	}
+	return e.File + ": " + e.Key + ": " + e.Err
+}
+
+// LoadConfig reads a Config from a JSON (.json) or TOML (.toml) file,
+// such as
+//
+//	socket = "/run/diamond/web.sock"
+//	socket_mode = "0660"
+//	pid_file = true
+//	kickable = true
+//	drain_timeout = "30s"
+//	runlevel = 3
+//
+//	[[listeners]]
+//	name = "https"
+//	type = "tls"
+//	addr = ":443"
+//	cert = "/etc/ssl/web.pem"
+//	key = "/etc/ssl/web.key"
+//
+// Unknown keys and bad values are errors, naming the key.
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, &ConfigError{File: path, Err: err.Error()}
+	}
+	m := make(map[string]interface{})
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		err = dec.Decode(&m)
+	case ".toml":
+		_, err = toml.Decode(string(b), &m)
+	default:
+		return nil, &ConfigError{File: path, Err: fmt.Sprintf("unknown format %q, want .json or .toml", ext)}
+	}
+	if err != nil {
+		return nil, &ConfigError{File: path, Err: err.Error()}
+	}
+	d := &configDecoder{file: path}
+	c := d.config(m)
+	if d.err != nil {
+		return nil, d.err
+	}
+	c.path = path
+	return c, nil
+}
+
+// configDecoder fills a Config from a decoded file, keeping the first error
+type configDecoder struct {
+	file string
+	err  error
+}
+
+// fail records an error at key, if there is none yet
+func (d *configDecoder) fail(key, format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = &ConfigError{File: d.file, Key: key, Err: fmt.Sprintf(format, args...)}
+	}
+}
+
+// table reads the known keys of a table, and fails on any other
+type table struct {
+	d      *configDecoder
+	prefix string // such as "listeners[1]."
+	m      map[string]interface{}
+	known  map[string]bool
+}
+
+func (d *configDecoder) table(prefix string, m map[string]interface{}) *table {
+	return &table{d: d, prefix: prefix, m: m, known: make(map[string]bool)}
+}
+
+func (t *table) get(key string) (interface{}, bool) {
+	t.known[key] = true
+	v, ok := t.m[key]
+	return v, ok
+}
+
+// unknown fails on the first (sorted) key that was not read
+func (t *table) unknown() {
+	var keys []string
+	for k := range t.m {
+		if !t.known[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) > 0 {
+		t.d.fail(t.prefix+keys[0], "unknown key")
+	}
+}
+
+func (t *table) str(key string) string {
+	v, ok := t.get(key)
+	if !ok {
+		return ""
+	}
+	s, ok := v.(string)
+	if !ok {
+		t.d.fail(t.prefix+key, "expected a string, got %v", v)
+	}
+	return s
+}
+
+func (t *table) boolean(key string) bool {
+	v, ok := t.get(key)
+	if !ok {
+		return false
+	}
+	b, ok := v.(bool)
+	if !ok {
+		t.d.fail(t.prefix+key, "expected true or false, got %v", v)
+	}
+	return b
+}
+
+func (t *table) integer(key string, def int) int {
+	v, ok := t.get(key)
+	if !ok {
+		return def
+	}
+	switch n := v.(type) {
+	case int64: // toml
+		return int(n)
+	case json.Number:
+		if i, err := n.Int64(); err == nil && i <= math.MaxInt32 && i >= math.MinInt32 {
+			return int(i)
+		}
+	}
+	t.d.fail(t.prefix+key, "expected a whole number, got %v", v)
+	return def
+}
+
+// level reads a runlevel, as a number or a name in DefaultRunlevelNames
+func (t *table) level(key string, def int) int {
+	name, ok := t.m[key].(string)
+	if !ok {
+		return t.integer(key, def)
+	}
+	t.known[key] = true
+	names := runlevelNames{byLevel: defaultNames()}
+	level, ok := names.lookup(name)
+	if !ok {
+		t.d.fail(t.prefix+key, "no runlevel named %q", name)
+		return def
+	}
+	return level
+}
+
+func (t *table) duration(key string) time.Duration {
+	s := t.str(key)
+	if s == "" {
+		return 0
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil || dur < 0 {
+		t.d.fail(t.prefix+key, "expected a duration such as \"10s\", got %q", s)
+	}
+	return dur
+}
+
+func (t *table) mode(key string) os.FileMode {
+	s := t.str(key)
+	if s == "" {
+		return 0
+	}
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 0777 {
+		t.d.fail(t.prefix+key, "expected permissions such as \"0660\", got %q", s)
+	}
+	return os.FileMode(n)
+}
+
+// tables reads an array of tables, such as [[listeners]]
+func (t *table) tables(key string) []map[string]interface{} {
+	v, ok := t.get(key)
+	if !ok {
+		return nil
+	}
+	switch list := v.(type) {
+	case []map[string]interface{}: // toml
+		return list
+	case []interface{}: // json
+		var tables []map[string]interface{}
+		for i, item := range list {
+			m, ok := item.(map[string]interface{})
+			if !ok {
+				t.d.fail(fmt.Sprintf("%s%s[%d]", t.prefix, key, i), "expected a table")
+				return nil
+			}
+			tables = append(tables, m)
+		}
+		return tables
+	}
+	t.d.fail(t.prefix+key, "expected a list of tables")
+	return nil
+}
+
+// sub reads a table, such as [metrics]
+func (t *table) sub(key string) map[string]interface{} {
+	v, ok := t.get(key)
+	if !ok {
+		return nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		t.d.fail(t.prefix+key, "expected a table")
+	}
+	return m
+}
+
+func (d *configDecoder) config(m map[string]interface{}) *Config {
+	t := d.table("", m)
+	c := &Config{
+		Socket:     t.str("socket"),
+		SocketMode: t.mode("socket_mode"),
+		PIDFile:    t.boolean("pid_file"),
+		Options: Options{
+			Verbose:       t.boolean("verbose"),
+			Kickable:      t.boolean("kickable"),
+			KickTokenFile: t.str("kick_token_file"),
+			KickNewerOnly: t.boolean("kick_newer_only"),
+			KickMinUptime: t.duration("kick_min_uptime"),
+			Force:         t.boolean("force"),
+			DrainTimeout:  t.duration("drain_timeout"),
+			DumpFile:      t.str("dump_file"),
+		},
+		Runlevel: t.level("runlevel", 3),
+	}
+	if _, ok := m["socket"]; !ok {
+		d.fail("socket", "required")
+	}
+	if c.Runlevel < 1 || c.Runlevel > 4 {
+		d.fail("runlevel", "expected 1 to 4, got %d", c.Runlevel)
+	}
+	for i, lm := range t.tables("listeners") {
+		c.Listeners = append(c.Listeners, d.listener(fmt.Sprintf("listeners[%d].", i), lm, true))
+	}
+	d.unique(c.Listeners)
+	if mm := t.sub("metrics"); mm != nil {
+		l := d.listener("metrics.", mm, false)
+		c.Metrics = &l
+	}
+	t.unknown()
+	return c
+}
+
+// listener reads a ListenerConfig, with name and tls for application listeners
+func (d *configDecoder) listener(prefix string, m map[string]interface{}, app bool) ListenerConfig {
+	t := d.table(prefix, m)
+	l := ListenerConfig{
+		Type: t.str("type"),
+		Addr: t.str("addr"),
+	}
+	if app {
+		l.Name = t.str("name")
+		l.Cert = t.str("cert")
+		l.Key = t.str("key")
+	}
+	t.unknown()
+	d.check(prefix, &l, app)
+	return l
+}
+
+// check a ListenerConfig, defaulting to tcp
+func (d *configDecoder) check(prefix string, l *ListenerConfig, app bool) {
+	if l.Type == "" {
+		l.Type = "tcp"
+	}
+	switch {
+	case l.Type == "tls" && !app:
+		d.fail(prefix+"type", `expected "tcp" or "unix", got %q`, l.Type)
+	case l.Type != "tcp" && l.Type != "unix" && l.Type != "tls":
+		d.fail(prefix+"type", `expected "tcp", "unix" or "tls", got %q`, l.Type)
+	}
+	if l.Addr == "" {
+		d.fail(prefix+"addr", "required")
+	}
+	if l.Type == "tls" {
+		if l.Cert == "" {
+			d.fail(prefix+"cert", "required for tls")
+		}
+		if l.Key == "" {
+			d.fail(prefix+"key", "required for tls")
+		}
+		if d.err == nil {
+			if _, err := tls.LoadX509KeyPair(l.Cert, l.Key); err != nil {
+				d.fail(prefix+"cert", "%v", err)
+			}
+		}
+	} else if l.Cert != "" || l.Key != "" {
+		d.fail(prefix+"type", `cert and key need type "tls"`)
+	}
+}
+
+// unique fails on listeners with the same address or name
+func (d *configDecoder) unique(listeners []ListenerConfig) {
+	seen := make(map[string]string)
+	for i, l := range listeners {
+		key := fmt.Sprintf("listeners[%d]", i)
+		if other, ok := seen[l.Addr]; ok {
+			d.fail(key+".addr", "%q is also %s", l.Addr, other)
+		}
+		seen[l.Addr] = key
+		if l.Name != "" {
+			if other, ok := seen["name "+l.Name]; ok {
+				d.fail(key+".name", "%q is also %s", l.Name, other)
+			}
+			seen["name "+l.Name] = key
+		}
+	}
+}
+
+// New creates a System as configured, with its listeners added, ready for
+// SetHandler and the rest before booting to c.Runlevel (Options.BootTarget).
+// If c was read by LoadConfig, RELOAD (see ReloadListeners) reads the
+// listeners from the same file:
+//
+//	c, err := diamond.LoadConfig("/etc/web.toml")
+//	...
+//	s, err := c.New()
+//	...
+//	s.SetHandler(mux)
+//	s.Boot()
+//	err = s.WaitBoot()
+func (c *Config) New() (*System, error) {
+	options := c.Options
+	if options.BootTarget == 0 {
+		options.BootTarget = c.Runlevel
+	}
+	s, err := newSystem(c.Socket, &options)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.apply(s); err != nil {
+		s.locklevel.Lock()
+		s.removePIDFile()
+		s.closeMetrics()
+		s.locklevel.Unlock()
+		s.controlListener.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// apply the Config to a new System, which already has its Options
+func (c *Config) apply(s *System) error {
+	if c.SocketMode != 0 {
+		if err := os.Chmod(s.controlSocket, c.SocketMode); err != nil {
+			return err
+		}
+	}
+	if c.PIDFile {
+		if err := s.LockPIDFile(); err != nil {
+			return err
+		}
+	}
+	for _, l := range c.Listeners {
+		if err := c.addListener(s, l); err != nil {
+			return err
+		}
+	}
+	if c.path != "" {
+		path := c.path
+		s.SetListenerLoader(func() ([]ListenerConfig, error) {
+			c, err := LoadConfig(path)
+			if err != nil {
+				return nil, err
+			}
+			return c.Listeners, nil
+		})
+	}
+	if c.Metrics != nil {
+		return s.ServeMetrics(c.Metrics.Type, c.Metrics.Addr)
+	}
+	return nil
+}
+
+func (c *Config) addListener(s *System, l ListenerConfig) (err error) {
+	if l.Type == "tls" {
+		_, err = s.AddTLSListener(l.Name, l.Addr, l.Cert, l.Key)
+	} else {
+		_, err = s.AddNamedListener(l.Name, l.Type, l.Addr)
+	}
+	return err
+}
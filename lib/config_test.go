@@ -0,0 +1,248 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file named name in dir
+func writeConfig(t *testing.T, dir, name, text string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(text), 0600); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diamond-config")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := testCert(t, dir)
+
+	tomlPath := writeConfig(t, dir, "web.toml", `
+socket = "/run/diamond/web.sock"
+socket_mode = "0660"
+pid_file = true
+kickable = true
+kick_min_uptime = "1m"
+drain_timeout = "30s"
+runlevel = 4
+
+[[listeners]]
+addr = ":8080"
+
+[[listeners]]
+name = "https"
+type = "tls"
+addr = ":8443"
+cert = "`+certFile+`"
+key = "`+keyFile+`"
+
+[metrics]
+addr = "127.0.0.1:9100"
+`)
+	jsonPath := writeConfig(t, dir, "web.json", `{
+	"socket": "/run/diamond/web.sock",
+	"socket_mode": "0660",
+	"pid_file": true,
+	"kickable": true,
+	"kick_min_uptime": "1m",
+	"drain_timeout": "30s",
+	"runlevel": 4,
+	"listeners": [
+		{"addr": ":8080"},
+		{"name": "https", "type": "tls", "addr": ":8443", "cert": "`+certFile+`", "key": "`+keyFile+`"}
+	],
+	"metrics": {"addr": "127.0.0.1:9100"}
+}`)
+	for _, path := range []string{tomlPath, jsonPath} {
+		c, err := LoadConfig(path)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		if c.Socket != "/run/diamond/web.sock" || c.SocketMode != 0660 || !c.PIDFile || c.Runlevel != 4 ||
+			!c.Options.Kickable || c.Options.KickMinUptime != time.Minute || c.Options.DrainTimeout != 30*time.Second {
+			t.Logf("%s: unexpected config: %+v", path, c)
+			t.FailNow()
+		}
+		if len(c.Listeners) != 2 || c.Listeners[0] != (ListenerConfig{Type: "tcp", Addr: ":8080"}) ||
+			c.Listeners[1] != (ListenerConfig{Name: "https", Type: "tls", Addr: ":8443", Cert: certFile, Key: keyFile}) {
+			t.Logf("%s: unexpected listeners: %+v", path, c.Listeners)
+			t.FailNow()
+		}
+		if c.Metrics == nil || *c.Metrics != (ListenerConfig{Type: "tcp", Addr: "127.0.0.1:9100"}) {
+			t.Logf("%s: unexpected metrics: %+v", path, c.Metrics)
+			t.FailNow()
+		}
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diamond-config")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	for _, test := range []struct {
+		name, text, want string
+	}{
+		{"c.toml", `runlevel = 3`, "socket: required"},
+		{"c.toml", "socket = \"s\"\nkickabel = true", "kickabel: unknown key"},
+		{"c.toml", "socket = \"s\"\nkickable = \"yes\"", "kickable: expected true or false, got yes"},
+		{"c.toml", "socket = \"s\"\nsocket_mode = \"rw\"", `socket_mode: expected permissions such as "0660", got "rw"`},
+		{"c.toml", "socket = \"s\"\ndrain_timeout = \"soon\"", `drain_timeout: expected a duration such as "10s", got "soon"`},
+		{"c.toml", "socket = \"s\"\nrunlevel = 9", "runlevel: expected 1 to 4, got 9"},
+		{"c.toml", "socket = \"s\"\nrunlevel = \"warp\"", `runlevel: no runlevel named "warp"`},
+		{"c.toml", "socket = \"s\"\n[[listeners]]\naddr = \":80\"\n[[listeners]]\ntype = \"unix\"", "listeners[1].addr: required"},
+		{"c.toml", "socket = \"s\"\n[[listeners]]\naddr = \":80\"\ntype = \"udp\"", `listeners[0].type: expected "tcp", "unix" or "tls", got "udp"`},
+		{"c.toml", "socket = \"s\"\n[[listeners]]\naddr = \":80\"\nport = 80", "listeners[0].port: unknown key"},
+		{"c.toml", "socket = \"s\"\n[[listeners]]\naddr = \":80\"\n[[listeners]]\naddr = \":80\"", `listeners[1].addr: ":80" is also listeners[0]`},
+		{"c.toml", "socket = \"s\"\n[[listeners]]\naddr = \":443\"\ntype = \"tls\"", "listeners[0].cert: required for tls"},
+		{"c.toml", "socket = \"s\"\n[[listeners]]\naddr = \":443\"\ntype = \"tls\"\ncert = \"nope.pem\"\nkey = \"nope.key\"", "listeners[0].cert: open nope.pem"},
+		{"c.toml", "socket = \"s\"\n[[listeners]]\naddr = \":80\"\ncert = \"c.pem\"", `listeners[0].type: cert and key need type "tls"`},
+		{"c.toml", "socket = \"s\"\n[metrics]\naddr = \":9100\"\ntype = \"tls\"", `metrics.type: expected "tcp" or "unix", got "tls"`},
+		{"c.toml", "socket = \"s\"\n[metrics]\naddr = \":9100\"\nname = \"m\"", `metrics.name: unknown key`},
+		{"c.toml", "socket = ", "c.toml: "},
+		{"c.json", `{"socket": "s", "runlevel": 3.5}`, "runlevel: expected a whole number, got 3.5"},
+		{"c.json", `{"socket": "s", "listeners": [":80"]}`, "listeners[0]: expected a table"},
+		{"c.json", `{"socket": "s", "listeners": {"addr": ":80"}}`, "listeners: expected a list of tables"},
+		{"c.yaml", `socket: s`, `unknown format ".yaml"`},
+	} {
+		path := writeConfig(t, dir, test.name, test.text)
+		_, err := LoadConfig(path)
+		if err == nil || !strings.HasPrefix(err.Error(), path+": ") || !strings.Contains(err.Error(), test.want) {
+			t.Logf("%q: expected error with %q, got %v", test.text, test.want, err)
+			t.FailNow()
+		}
+		if _, ok := err.(*ConfigError); !ok {
+			t.Logf("expected a *ConfigError, got %T", err)
+			t.FailNow()
+		}
+	}
+}
+
+func TestConfigNew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diamond-config")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "web.sock")
+	path := writeConfig(t, dir, "web.toml", `
+socket = "`+socket+`"
+socket_mode = "0600"
+pid_file = true
+drain_timeout = "3s"
+
+[[listeners]]
+name = "web"
+addr = "127.0.0.1:30114"
+
+[metrics]
+addr = "127.0.0.1:30115"
+`)
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	s, err := c.New()
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer s.Runlevel(0)
+	if fi, err := os.Stat(socket); err != nil || fi.Mode().Perm() != 0600 {
+		t.Logf("expected socket with mode 0600: %v %v", fi.Mode(), err)
+		t.FailNow()
+	}
+	if s.Config.DrainTimeout != 3*time.Second {
+		t.Logf("expected options from config, got %+v", s.Config)
+		t.FailNow()
+	}
+	s.SetHandler(foohandler)
+	if err := s.Runlevel(c.Runlevel); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	testGet(t, "127.0.0.1:30114")
+	if st := s.Status(); st.PIDFile == "" || st.Stats[0].Name != "web" {
+		t.Logf("expected pid file and named listener: %+v", st)
+		t.FailNow()
+	}
+	resp, err := http.Get("http://127.0.0.1:30115/metrics")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	resp.Body.Close()
+	s.Runlevel(1)
+
+	// a second system on the same config fails, without leaving anything behind
+	if _, err := c.New(); err == nil {
+		t.Log("expected error starting twice")
+		t.FailNow()
+	}
+	if _, err := os.Stat(socket); err != nil {
+		t.Logf("expected the first system's socket to remain: %v", err)
+		t.FailNow()
+	}
+
+	// a failure after New removes the socket and pid file
+	busy, err := net.Listen("tcp", "127.0.0.1:30116")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer busy.Close()
+	other := filepath.Join(dir, "other.sock")
+	c = &Config{Socket: other, PIDFile: true, Metrics: &ListenerConfig{Type: "tcp", Addr: "127.0.0.1:30116"}}
+	if _, err := c.New(); err == nil {
+		t.Log("expected error serving metrics on a busy port")
+		t.FailNow()
+	}
+	for _, left := range []string{other, pidFilePath(other)} {
+		if _, err := os.Stat(left); err == nil {
+			t.Logf("%s was left behind", left)
+			t.FailNow()
+		}
+	}
+}
@@ -0,0 +1,186 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// ListenerStats counts connections on one listener, as returned by
+// ListenerStats and the STATUS command
+type ListenerStats struct {
+	Name     string `json:",omitempty"`
+	Type     string
+	Addr     string
+	Open     bool  // listening
+	Active   int64 // connections handling a request
+	Idle     int64 // connections waiting for another request
+	Conns    int64 // connections open now (Accepted - Closed), what runlevel 1 would cut
+	Accepted int64 // since AddListener
+	Closed   int64 // since AddListener, including hijacked connections
+	BytesIn  int64 // read from connections
+	BytesOut int64 // written to connections
+}
+
+// counters are kept for the life of a listener, across runlevels (atomic)
+type counters struct {
+	active, idle, accepted, closed, in, out int64
+
+	open sync.Map // *countedConn, to close when draining one listener
+}
+
+// conns is the number of connections open now
+func (c *counters) conns() int64 {
+	return atomic.LoadInt64(&c.accepted) - atomic.LoadInt64(&c.closed)
+}
+
+// connection states, as seen by connState
+const (
+	stateNew int32 = iota
+	stateActive
+	stateIdle
+	stateDone
+)
+
+// countedListener counts accepted connections, wrapping them in countedConn
+type countedListener struct {
+	net.Listener
+	c *counters
+}
+
+func (l *countedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&l.c.accepted, 1)
+	cc := &countedConn{Conn: conn, c: l.c}
+	l.c.open.Store(cc, nil)
+	return cc, nil
+}
+
+// countedConn counts bytes, and closes once
+type countedConn struct {
+	net.Conn
+	c      *counters
+	state  int32 // see connState
+	closed int32
+}
+
+func (c *countedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.c.in, int64(n))
+	return n, err
+}
+
+func (c *countedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.c.out, int64(n))
+	return n, err
+}
+
+// ReadFrom keeps sendfile for TCP connections
+func (c *countedConn) ReadFrom(r io.Reader) (n int64, err error) {
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{c.Conn}, r)
+	}
+	atomic.AddInt64(&c.c.out, n)
+	return n, err
+}
+
+func (c *countedConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		c.c.open.Delete(c)
+		atomic.AddInt64(&c.c.closed, 1)
+	}
+	return c.Conn.Close()
+}
+
+// count moves a connection between active and idle
+func (c *countedConn) count(state http.ConnState) {
+	var next int32
+	switch state {
+	case http.StateActive:
+		next = stateActive
+	case http.StateIdle:
+		next = stateIdle
+	case http.StateClosed, http.StateHijacked:
+		next = stateDone
+	default:
+		return
+	}
+	switch atomic.SwapInt32(&c.state, next) {
+	case stateActive:
+		atomic.AddInt64(&c.c.active, -1)
+	case stateIdle:
+		atomic.AddInt64(&c.c.idle, -1)
+	}
+	switch next {
+	case stateActive:
+		atomic.AddInt64(&c.c.active, 1)
+	case stateIdle:
+		atomic.AddInt64(&c.c.idle, 1)
+	}
+}
+
+// ListenerStats returns connection counters for each listener
+func (s *System) ListenerStats() []ListenerStats {
+	s.locklevel.Lock()
+	defer s.locklevel.Unlock()
+	return s.listenerStats()
+}
+
+// listenerStats is ListenerStats, caller holds locklevel
+func (s *System) listenerStats() []ListenerStats {
+	stats := make([]ListenerStats, len(s.listeners))
+	for i, l := range s.listeners {
+		c := l.counters
+		stats[i] = ListenerStats{
+			Name:     l.name,
+			Type:     l.ltype,
+			Addr:     l.laddr,
+			Open:     l.listener != nil,
+			Active:   atomic.LoadInt64(&c.active),
+			Idle:     atomic.LoadInt64(&c.idle),
+			Accepted: atomic.LoadInt64(&c.accepted),
+			Closed:   atomic.LoadInt64(&c.closed),
+			BytesIn:  atomic.LoadInt64(&c.in),
+			BytesOut: atomic.LoadInt64(&c.out),
+		}
+		stats[i].Conns = stats[i].Accepted - stats[i].Closed
+	}
+	return stats
+}
+
+// CountConnections returns the number of open http connections, on all listeners
+func (s *System) CountConnections() int64 {
+	return atomic.LoadInt64(&s.conns)
+}
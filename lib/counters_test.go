@@ -0,0 +1,97 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestListenerStats(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	addr := "127.0.0.1:30108"
+	release := make(chan struct{})
+	srv.SetHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprintln(w, "done")
+	}))
+	srv.AddNamedListener("web", "tcp", addr)
+	if err := srv.Runlevel(3); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer srv.Runlevel(1)
+
+	got := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/")
+		if err == nil {
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		got <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	st := srv.ListenerStats()[0]
+	if st.Name != "web" || !st.Open || st.Active != 1 || st.Conns != 1 || st.Accepted != 1 || st.BytesIn == 0 {
+		t.Logf("unexpected stats during request: %+v", st)
+		t.FailNow()
+	}
+	if n := srv.CountConnections(); n != 1 {
+		t.Logf("expected 1 connection, got %d", n)
+		t.FailNow()
+	}
+
+	close(release)
+	if err := <-got; err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	time.Sleep(100 * time.Millisecond)
+	client, err := NewClient(socket)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	status, err := client.Status()
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if len(status.Stats) != 1 {
+		t.Logf("expected stats for 1 listener, got %+v", status.Stats)
+		t.FailNow()
+	}
+	st = status.Stats[0]
+	if st.Active != 0 || st.Idle != 0 || st.Conns != 0 || st.Closed != 1 || st.BytesOut == 0 {
+		t.Logf("unexpected stats after request: %+v", st)
+		t.FailNow()
+	}
+}
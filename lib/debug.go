@@ -0,0 +1,178 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// debugSuffix is added to the control socket path, for the runlevel 4 debug socket
+const debugSuffix = ".debug"
+
+// openDebug serves pprof and expvar on a unix socket next to the control
+// socket, never on the public listeners. Caller holds locklevel.
+func (s *System) openDebug() error {
+	if s.debug != nil {
+		return nil
+	}
+	path := s.controlSocket + debugSuffix
+	if _, err := os.Stat(path); err == nil {
+		s.log(LevelWarn, "removing stale socket "+path)
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, CHMODFILE); err != nil {
+		l.Close()
+		return fmt.Errorf("could not change permissions on debug socket: %v", err)
+	}
+	s.debug = &http.Server{Handler: debugHandler()}
+	s.debugListener = l.(*net.UnixListener)
+	go s.debug.Serve(l)
+	s.event("serving pprof and expvar on %s", path)
+	return nil
+}
+
+// closeDebug closes the debug socket, if open. Caller holds locklevel.
+func (s *System) closeDebug() {
+	if s.debug == nil {
+		return
+	}
+	if s.handedoff {
+		// the new process may be using the same path by now
+		s.debugListener.SetUnlinkOnClose(false)
+	}
+	s.debug.Close()
+	s.debug, s.debugListener = nil, nil
+	s.event("closed debug socket")
+}
+
+// debugHandler serves /debug/pprof/ and /debug/vars
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprofIndex)
+	mux.HandleFunc("/debug/pprof/cmdline", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, strings.Join(os.Args, "\x00"))
+	})
+	mux.HandleFunc("/debug/pprof/profile", pprofCPU)
+	mux.HandleFunc("/debug/pprof/trace", pprofTrace)
+	mux.Handle("/debug/vars", expvarHandler())
+	return mux
+}
+
+// seconds is the "seconds" query parameter, or def
+func seconds(r *http.Request, def int) time.Duration {
+	n, err := strconv.Atoi(r.FormValue("seconds"))
+	if err != nil || n <= 0 {
+		n = def
+	}
+	return time.Duration(n) * time.Second
+}
+
+// pprofIndex lists the profiles, or writes the one named in the path
+func pprofIndex(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+	if name == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		var names []string
+		for _, p := range pprof.Profiles() {
+			names = append(names, fmt.Sprintf("%s (%d)", p.Name(), p.Count()))
+		}
+		sort.Strings(names)
+		names = append(names, "cmdline", "profile (CPU, ?seconds=30)", "trace (?seconds=1)")
+		fmt.Fprintln(w, strings.Join(names, "\n"))
+		return
+	}
+	p := pprof.Lookup(name)
+	if p == nil {
+		http.Error(w, "unknown profile "+name, http.StatusNotFound)
+		return
+	}
+	debug, _ := strconv.Atoi(r.FormValue("debug"))
+	if name == "heap" && r.FormValue("gc") != "" {
+		runtime.GC()
+	}
+	if debug == 0 {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	p.WriteTo(w, debug)
+}
+
+func pprofCPU(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	if err := pprof.StartCPUProfile(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	time.Sleep(seconds(r, 30))
+	pprof.StopCPUProfile()
+}
+
+func pprofTrace(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="trace"`)
+	if err := trace.Start(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	time.Sleep(seconds(r, 1))
+	trace.Stop()
+}
+
+// expvarHandler is the program's expvar handler, if it imports expvar.
+// Importing expvar (or net/http/pprof) here would put it on the public
+// listeners too, since they serve http.DefaultServeMux by default.
+func expvarHandler() http.Handler {
+	h, pattern := http.DefaultServeMux.Handler(&http.Request{Method: "GET", URL: &url.URL{Path: "/debug/vars"}})
+	if pattern == "/debug/vars" {
+		return h
+	}
+	// the same as expvar, without any published variables
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(map[string]interface{}{"cmdline": os.Args, "memstats": m})
+	})
+}
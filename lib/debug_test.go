@@ -0,0 +1,116 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+// getUnix gets path from an http server on a unix socket
+func getUnix(socket, path string) (int, string, error) {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://diamond" + path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(b), err
+}
+
+func TestDebugRunlevel(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	addr := "127.0.0.1:30112"
+	srv.AddListener("tcp", addr)
+	if err := srv.Runlevel(3); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer srv.Runlevel(1)
+	debug := socket + debugSuffix
+	if _, err := os.Stat(debug); err == nil {
+		t.Log("debug socket exists in runlevel 3")
+		t.FailNow()
+	}
+
+	if err := srv.Runlevel(4); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if st := srv.Status(); st.Debug != debug || st.Open != 1 {
+		t.Logf("expected debug socket and open listener in status: %+v", st)
+		t.FailNow()
+	}
+	for path, want := range map[string]string{
+		"/debug/pprof/":                  "goroutine (",
+		"/debug/pprof/goroutine?debug=1": "TestDebugRunlevel",
+		"/debug/pprof/cmdline":           os.Args[0],
+		"/debug/vars":                    `"memstats":`,
+	} {
+		code, body, err := getUnix(debug, path)
+		if err != nil || code != http.StatusOK || !strings.Contains(body, want) {
+			t.Logf("%s: expected %q, got %d %q (%v)", path, want, code, body, err)
+			t.FailNow()
+		}
+	}
+
+	// never on the public listeners, which serve http.DefaultServeMux here
+	for _, path := range []string{"/debug/pprof/", "/debug/vars"} {
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Logf("%s served on public listener: %s", path, resp.Status)
+			t.FailNow()
+		}
+	}
+
+	if err := srv.Runlevel(3); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if _, err := os.Stat(debug); err == nil {
+		t.Log("debug socket still exists after leaving runlevel 4")
+		t.FailNow()
+	}
+	if st := srv.Status(); st.Debug != "" || st.Open != 1 {
+		t.Logf("expected no debug socket and open listener in status: %+v", st)
+		t.FailNow()
+	}
+}
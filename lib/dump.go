@@ -0,0 +1,159 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"runtime"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// lockProbe is how long Dump waits for the runlevel lock before calling it held
+var lockProbe = 100 * time.Millisecond
+
+// Dump writes what is needed to see why a transition hangs: the runlevel,
+// who holds the runlevel lock, the listeners, Options and goroutine stacks.
+// It never waits for a transition.
+func (s *System) Dump(w io.Writer) {
+	s.metrics.mu.Lock()
+	level, listeners := s.metrics.level, s.metrics.listeners
+	s.metrics.mu.Unlock()
+
+	fmt.Fprintf(w, "diamond dump at %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "pid %d, version %q, up %v, socket %s\n\n", os.Getpid(), s.version,
+		time.Since(s.started).Round(time.Second), s.controlSocket)
+	fmt.Fprintf(w, "runlevel %d\n", level)
+	s.history.mu.Lock()
+	current := s.history.current
+	s.history.mu.Unlock()
+	switch {
+	case current != nil:
+		fmt.Fprintf(w, "runlevel lock held by runlevel %d -> %d, asked by %s, for %v\n",
+			current.From, current.To, current.Requester, time.Since(current.Time).Round(time.Millisecond))
+	case s.lockHeld():
+		fmt.Fprintln(w, "runlevel lock held, not by a transition")
+	default:
+		fmt.Fprintln(w, "runlevel lock free")
+	}
+	fmt.Fprintf(w, "%d open http connections\n\n", atomic.LoadInt64(&s.conns))
+
+	fmt.Fprintln(w, "listeners:")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tTYPE\tADDR\tOPEN\tACTIVE\tIDLE\tACCEPTED\tCLOSED\tIN\tOUT")
+	for _, l := range listeners {
+		name := l.name
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t%d\t%d\t%d\t%d\t%d\t%d\n", name, l.ltype, l.addr, l.open,
+			atomic.LoadInt64(&l.c.active), atomic.LoadInt64(&l.c.idle), atomic.LoadInt64(&l.c.accepted),
+			atomic.LoadInt64(&l.c.closed), atomic.LoadInt64(&l.c.in), atomic.LoadInt64(&l.c.out))
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w, "\noptions:")
+	v := reflect.ValueOf(*s.Config)
+	for i := 0; i < v.NumField(); i++ {
+		fmt.Fprintf(w, "  %s: %v\n", v.Type().Field(i).Name, v.Field(i).Interface())
+	}
+	fmt.Fprintf(w, "  (drain timeout %v)\n", s.drainTimeout())
+
+	fmt.Fprintln(w, "\ngoroutines:")
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	w.Write(buf)
+}
+
+// lockHeld is true if the runlevel lock can't be taken within lockProbe
+func (s *System) lockHeld() bool {
+	got := make(chan struct{})
+	go func() {
+		s.locklevel.Lock()
+		s.locklevel.Unlock()
+		close(got)
+	}()
+	select {
+	case <-got:
+		return false
+	case <-time.After(lockProbe):
+		return true
+	}
+}
+
+// dump writes a Dump to Options.DumpFile, if set, and returns it
+func (s *System) dump() ([]byte, error) {
+	var buf bytes.Buffer
+	s.Dump(&buf)
+	if path := s.Config.DumpFile; path != "" {
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+			return buf.Bytes(), err
+		}
+		s.event("dumped to %s", path)
+	}
+	return buf.Bytes(), nil
+}
+
+// LogDump writes a Dump to Options.DumpFile, or the log if not set.
+// It is mapped to SIGUSR1 by DefaultSignals.
+func (s *System) LogDump() error {
+	b, err := s.dump()
+	if err != nil {
+		return err
+	}
+	if s.Config.DumpFile == "" {
+		s.Log.Writer().Write(b)
+	}
+	return nil
+}
+
+// Dump replies with a Dump, also writing it to Options.DumpFile if set.
+// arg is ignored, clients never choose where the server writes.
+func (p *packet) Dump(arg string, reply *string) error {
+	b, err := p.parent.dump()
+	if err != nil {
+		*reply = string(b)
+		return err
+	}
+	*reply = string(b)
+	return nil
+}
+
+func (p *packet) DUMP(arg string, reply *string) error {
+	return p.Dump(arg, reply)
+}
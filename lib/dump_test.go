@@ -0,0 +1,126 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDump(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	srv.AddNamedListener("web", "tcp", "127.0.0.1:30111")
+	entered, release := make(chan struct{}), make(chan struct{})
+	srv.SetRunlevel(2, func() error {
+		close(entered)
+		<-release
+		return nil
+	})
+	shifted := make(chan error, 1)
+	go func() { shifted <- srv.RunlevelBy(2, "test") }()
+	<-entered
+
+	f, err := ioutil.TempFile("", "diamond-dump")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	srv.Config.DumpFile = f.Name()
+	client, err := NewClient(socket)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	// a path from the client is never written
+	other := f.Name() + ".other"
+	reply, err := client.Send("dump", other)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if _, err := os.Stat(other); !os.IsNotExist(err) {
+		os.Remove(other)
+		t.Logf("expected no file at the client's path, got %v", err)
+		t.FailNow()
+	}
+	for _, want := range []string{
+		"runlevel 0\n",
+		"runlevel lock held by runlevel 0 -> 2, asked by test, for ",
+		"web   tcp   127.0.0.1:30111  false",
+		"  Kickable: false\n",
+		"  (drain timeout 10s)\n",
+		"goroutines:\ngoroutine ",
+		"TestDump",
+	} {
+		if !strings.Contains(reply, want) {
+			t.Logf("expected %q in dump:\n%s", want, reply)
+			t.FailNow()
+		}
+	}
+	b, _ := ioutil.ReadFile(f.Name())
+	if string(b) != reply {
+		t.Logf("expected the dump in %s, got %q", f.Name(), b)
+		t.FailNow()
+	}
+
+	close(release)
+	if err := <-shifted; err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	srv.Config.DumpFile = ""
+	var buf bytes.Buffer
+	srv.Log = log.New(&buf, "", 0)
+	if err := srv.LogDump(); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if !strings.Contains(buf.String(), "runlevel 2\nrunlevel lock free\n") {
+		t.Logf("expected runlevel 2 and a free lock in logged dump:\n%s", buf.String())
+		t.FailNow()
+	}
+}
+
+func TestDumpLockHeld(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	srv.locklevel.Lock()
+	var buf bytes.Buffer
+	start := time.Now()
+	srv.Dump(&buf)
+	srv.locklevel.Unlock()
+	if !strings.Contains(buf.String(), "runlevel lock held, not by a transition\n") || time.Since(start) > time.Second {
+		t.Logf("expected held lock in dump:\n%s", buf.String())
+		t.FailNow()
+	}
+}
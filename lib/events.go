@@ -0,0 +1,121 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MaxEvents is how many recent events are kept for the EVENTS command
+var MaxEvents = 200
+
+// Event is something that happened in a diamond system, such as a runlevel change
+type Event struct {
+	Seq  int       // increasing sequence number
+	Time time.Time // when it happened
+	Text string    // what happened
+}
+
+func (e Event) String() string {
+	return e.Time.Format("15:04:05") + " " + e.Text
+}
+
+// eventlog holds the most recent events
+type eventlog struct {
+	mu     sync.Mutex
+	seq    int
+	events []Event
+}
+
+// event records a new event and logs it, with any fields
+func (s *System) event(format string, args ...interface{}) {
+	text := fmt.Sprintf(format, args...)
+	s.output(1, LevelInfo, text)
+	s.record(text)
+}
+
+// record adds an event, without logging it
+func (s *System) record(text string) {
+	s.events.mu.Lock()
+	defer s.events.mu.Unlock()
+	s.events.seq++
+	s.events.events = append(s.events.events, Event{Seq: s.events.seq, Time: time.Now(), Text: text})
+	if n := len(s.events.events) - MaxEvents; n > 0 {
+		s.events.events = append(s.events.events[:0], s.events.events[n:]...)
+	}
+}
+
+// Events returns recorded events with a sequence number greater than since
+func (s *System) Events(since int) []Event {
+	s.events.mu.Lock()
+	defer s.events.mu.Unlock()
+	var events []Event
+	for _, e := range s.events.events {
+		if e.Seq > since {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func (p *packet) Events(arg string, reply *string) error {
+	var since int
+	if arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			*reply = "error"
+			return err
+		}
+		since = n
+	}
+	b, err := json.Marshal(p.parent.Events(since))
+	if err != nil {
+		*reply = "error"
+		return err
+	}
+	*reply = string(b)
+	return nil
+}
+
+func (p *packet) EVENTS(arg string, reply *string) error {
+	return p.Events(arg, reply)
+}
+
+// Events sends the EVENTS command, returning events newer than since
+func (c *Client) Events(since int) ([]Event, error) {
+	reply, err := c.Send("EVENTS", strconv.Itoa(since))
+	if err != nil {
+		return nil, err
+	}
+	var events []Event
+	if err := json.Unmarshal([]byte(reply), &events); err != nil {
+		return nil, fmt.Errorf("bad events reply: %v", err)
+	}
+	return events, nil
+}
@@ -0,0 +1,69 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestClientEvents(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	srv.SetRunlevel(1, func() error { return nil })
+	if err := srv.Runlevel(1); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	client, err := NewClient(socket)
+	if err != nil {
+		t.Logf("tried to create client, got error: %v", err)
+		t.FailNow()
+	}
+	events, err := client.Events(0)
+	if err != nil {
+		t.Logf("tried to get events, got error: %v", err)
+		t.FailNow()
+	}
+	if len(events) == 0 || events[len(events)-1].Text != "runlevel 0 -> 1" {
+		t.Logf("wanted runlevel event, got: %v", events)
+		t.FailNow()
+	}
+
+	// only newer events
+	last := events[len(events)-1].Seq
+	client.Send("HELLO", "from test")
+	events, err = client.Events(last)
+	if err != nil {
+		t.Logf("tried to get events, got error: %v", err)
+		t.FailNow()
+	}
+	if len(events) != 1 || !strings.HasPrefix(events[0].Text, "HELLO") {
+		t.Logf("wanted one HELLO event, got: %v", events)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,135 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MaxHistory is how many runlevel transitions are kept for the HISTORY command
+var MaxHistory = 100
+
+// Transition is a runlevel change, or an attempt at one
+type Transition struct {
+	Time      time.Time     // when it started
+	From      int           // runlevel before
+	To        int           // runlevel asked for
+	Level     int           // runlevel after, the same as To unless it failed
+	Requester string        // who asked, such as "api", "signal", "watchdog" or "control (admin)"
+	Took      time.Duration // how long it took
+	Result    string        // "ok" or "error"
+	Error     string        `json:",omitempty"`
+}
+
+func (t Transition) String() string {
+	s := fmt.Sprintf("%s runlevel %d -> %d by %s in %v: %s", t.Time.Format("2006-01-02 15:04:05"),
+		t.From, t.To, t.Requester, t.Took, t.Result)
+	if t.Error != "" {
+		s += " (" + t.Error + ")"
+	}
+	return s
+}
+
+// history holds the most recent transitions
+type history struct {
+	mu          sync.Mutex
+	transitions []Transition
+	current     *Transition // in progress, for Dump
+}
+
+func (h *history) begin(t Transition) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.current = &t
+}
+
+func (h *history) add(t Transition) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.current = nil
+	h.transitions = append(h.transitions, t)
+	if n := len(h.transitions) - MaxHistory; n > 0 {
+		h.transitions = append(h.transitions[:0], h.transitions[n:]...)
+	}
+}
+
+// History returns the last n runlevel transitions, oldest first,
+// or all that are kept if n is 0
+func (s *System) History(n int) []Transition {
+	s.history.mu.Lock()
+	defer s.history.mu.Unlock()
+	t := s.history.transitions
+	if n > 0 && n < len(t) {
+		t = t[len(t)-n:]
+	}
+	return append([]Transition(nil), t...)
+}
+
+// requester is who is asking for a runlevel change on this connection
+func (p *packet) requester() string {
+	if p.peer.name == "" {
+		return "control"
+	}
+	return "control (" + p.peer.name + ")"
+}
+
+func (p *packet) History(arg string, reply *string) error {
+	var n int
+	if arg != "" {
+		var err error
+		if n, err = strconv.Atoi(arg); err != nil {
+			*reply = "error"
+			return err
+		}
+	}
+	b, err := json.Marshal(p.parent.History(n))
+	if err != nil {
+		*reply = "error"
+		return err
+	}
+	*reply = string(b)
+	return nil
+}
+
+func (p *packet) HISTORY(arg string, reply *string) error {
+	return p.History(arg, reply)
+}
+
+// History sends the HISTORY command, returning the last n transitions (0 for all)
+func (c *Client) History(n int) ([]Transition, error) {
+	reply, err := c.Send("HISTORY", strconv.Itoa(n))
+	if err != nil {
+		return nil, err
+	}
+	var t []Transition
+	if err := json.Unmarshal([]byte(reply), &t); err != nil {
+		return nil, fmt.Errorf("bad history reply: %v", err)
+	}
+	return t, nil
+}
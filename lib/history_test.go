@@ -0,0 +1,97 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	srv.SetRunlevel(2, func() error { return fmt.Errorf("not today") })
+	if err := srv.Runlevel(1); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	client, err := NewClient(socket)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	client.Name = "oncall"
+	client.Token = "x" // so HELLO is sent
+	if _, err := client.Send("runlevel", "2"); err == nil {
+		t.Log("expected runlevel 2 to fail")
+		t.FailNow()
+	}
+	if err := srv.Runlevel(3); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if err := srv.Restart(); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	history, err := client.History(0)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if len(history) != 5 {
+		t.Logf("expected 5 transitions, got %v", history)
+		t.FailNow()
+	}
+	first, failed := history[0], history[1]
+	if first.From != 0 || first.To != 1 || first.Level != 1 || first.Requester != "api" || first.Result != "ok" || first.Time.IsZero() {
+		t.Logf("unexpected first transition: %+v", first)
+		t.FailNow()
+	}
+	if failed.To != 2 || failed.Level != 1 || failed.Requester != "control (oncall)" || failed.Result != "error" || failed.Error == "" {
+		t.Logf("unexpected failed transition: %+v", failed)
+		t.FailNow()
+	}
+	if history[3].Requester != "restart" || history[4].Requester != "restart" || history[4].To != 3 {
+		t.Logf("expected restart 3 -> 1 -> 3, got %v", history[3:])
+		t.FailNow()
+	}
+
+	last, err := client.History(1)
+	if err != nil || len(last) != 1 || last[0].From != 1 || last[0].To != 3 || last[0].Requester != "restart" {
+		t.Logf("expected the last transition, got %v (%v)", last, err)
+		t.FailNow()
+	}
+
+	defer func(max int) { MaxHistory = max }(MaxHistory)
+	MaxHistory = 2
+	srv.Runlevel(1)
+	if h := srv.History(0); len(h) != 2 || h[0].To != 3 || h[1].To != 1 {
+		t.Logf("expected the last 2 transitions, got %v", h)
+		t.FailNow()
+	}
+}
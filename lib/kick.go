@@ -0,0 +1,228 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// KICK modes
+const (
+	// KickImmediate closes listeners and open connections right away
+	KickImmediate = "immediate"
+	// KickDrain closes listeners, and replies once open connections
+	// finish or the deadline passes
+	KickDrain = "drain"
+	// KickHandoff closes listeners and replies right away with the
+	// application state, draining open connections afterwards
+	KickHandoff = "handoff"
+)
+
+// KickMode is sent by New when taking over a running server.
+// An empty mode sends a plain KICK, which older servers understand.
+var KickMode = KickHandoff
+
+// KickDeadline is sent by New along with KickMode, if set. Otherwise the
+// old server uses its own Options.DrainTimeout.
+var KickDeadline time.Duration
+
+// KickResult is the reply to KICK with a mode
+type KickResult struct {
+	Mode    string          // immediate, drain or handoff
+	PID     int             // process that was kicked
+	Open    int64           // connections open when kicked
+	Drained int64           // connections that finished before the deadline
+	Closed  int64           // connections closed at the deadline
+	Took    time.Duration   // from KICK until the reply
+	State   json.RawMessage `json:",omitempty"` // handoff only, see SetStateSaver
+}
+
+func (r KickResult) String() string {
+	return fmt.Sprintf("kicked pid %d (%s): %d open, %d drained, %d closed in %v",
+		r.PID, r.Mode, r.Open, r.Drained, r.Closed, r.Took)
+}
+
+// parseKick reads the KICK argument: [mode [deadline]]
+func parseKick(arg string) (mode string, deadline time.Duration, err error) {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return KickImmediate, 0, nil
+	}
+	if len(fields) > 2 {
+		return "", 0, fmt.Errorf("usage: KICK [immediate|drain|handoff [deadline]]")
+	}
+	mode = strings.ToLower(fields[0])
+	switch mode {
+	case KickImmediate, KickDrain, KickHandoff:
+	default:
+		return "", 0, fmt.Errorf("unknown KICK mode %q", fields[0])
+	}
+	if len(fields) == 2 {
+		if deadline, err = time.ParseDuration(fields[1]); err != nil {
+			return "", 0, fmt.Errorf("bad KICK deadline: %v", err)
+		}
+	}
+	return mode, deadline, nil
+}
+
+// Kicked returns the reply from the server this one took over in New,
+// or nil if there was none (or it was too old to send one)
+func (s *System) Kicked() *KickResult {
+	return s.kicked
+}
+
+// kick frees the control socket, pid file and listeners for a new process.
+// The caller shifts to runlevel 0 (draining first, in handoff mode) after
+// replying.
+func (s *System) kick(mode string, deadline time.Duration) (*KickResult, error) {
+	start := time.Now()
+	s.locklevel.Lock()
+	if s.handedoff {
+		s.locklevel.Unlock()
+		return nil, fmt.Errorf("already kicked")
+	}
+	s.handedoff = true
+	r := &KickResult{Mode: mode, PID: os.Getpid(), Open: atomic.LoadInt64(&s.conns)}
+	s.controlListener.Close()
+	if err := os.Remove(s.controlSocket); err != nil && !os.IsNotExist(err) {
+		s.log(LevelWarn, "error removing socket", FieldError, err)
+	}
+	s.removePIDFile()
+	s.locklevel.Unlock()
+
+	switch mode {
+	case KickImmediate:
+		s.Server.Close()
+		r.Closed = r.Open
+	case KickDrain:
+		r.Drained, r.Closed = s.drain(deadline)
+	case KickHandoff:
+		s.locklevel.Lock()
+		for _, l := range s.listeners {
+			if l.listener != nil {
+				l.listener.Close()
+			}
+		}
+		b, err := s.marshalState()
+		s.locklevel.Unlock()
+		if err != nil {
+			s.event("KICK: %v", err)
+		}
+		r.State = b
+	}
+	r.Took = time.Since(start)
+	s.event("%v", r)
+	return r, nil
+}
+
+// drainTimeout is Options.DrainTimeout, or DefaultDrainTimeout
+func (s *System) drainTimeout() time.Duration {
+	if s.Config.DrainTimeout > 0 {
+		return s.Config.DrainTimeout
+	}
+	return DefaultDrainTimeout
+}
+
+// drain stops accepting, and waits for open connections to finish, closing
+// those still open after the deadline (default drainTimeout)
+func (s *System) drain(deadline time.Duration) (drained, closed int64) {
+	if deadline <= 0 {
+		deadline = s.drainTimeout()
+	}
+	open := atomic.LoadInt64(&s.conns)
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+	if err := s.Server.Shutdown(ctx); err != nil {
+		closed = atomic.LoadInt64(&s.conns)
+		s.Server.Close()
+	}
+	if drained = open - closed; drained < 0 {
+		drained = 0
+	}
+	s.event("drained %d connections, closed %d", drained, closed)
+	return drained, closed
+}
+
+// stop shifts to runlevel 0 after handing over, making sure Wait returns
+func (s *System) stop() {
+	if err := s.RunlevelBy(0, "handoff"); err != nil {
+		// nothing left to serve, Wait returns anyway
+		select {
+		case s.done <- 1:
+		default:
+		}
+	}
+}
+
+// Kick frees the control socket and listeners for a new process.
+// With no argument the reply is OKAY, otherwise KickResult as JSON.
+func (p *packet) Kick(arg string, reply *string) error {
+	p.parent.event("KICK %s %s", arg, p.peer)
+	if err := p.parent.refuseKick(p.peer); err != nil {
+		p.parent.event("refused KICK: %v", err)
+		*reply = "NOWAY"
+		return fmt.Errorf("NOWAY: %v", err)
+	}
+	mode, deadline, err := parseKick(arg)
+	if err != nil {
+		*reply = "error"
+		return err
+	}
+	r, err := p.parent.kick(mode, deadline)
+	if err != nil {
+		*reply = "error"
+		return err
+	}
+
+	// shift to runlevel 0 once the reply is sent, or the program may exit first
+	p.conn.SetReadDeadline(time.Now().Add(time.Second))
+	p.after = func() {
+		if mode == KickHandoff {
+			p.parent.drain(deadline)
+		}
+		p.parent.stop()
+	}
+	if arg == "" {
+		*reply = "OKAY"
+		return nil
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		*reply = "error"
+		return err
+	}
+	*reply = string(b)
+	return nil
+}
+
+func (p *packet) KICK(arg string, reply *string) error {
+	return p.Kick(arg, reply)
+}
@@ -0,0 +1,146 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// kickSlow kicks a server in the middle of a slow request
+func kickSlow(t *testing.T, addr, mode string) (*KickResult, error) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	srv.Config.Kickable = true
+	srv.SetHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		fmt.Fprintln(w, "slow")
+	}))
+	srv.AddListener("tcp", addr)
+	if err := srv.Runlevel(3); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	requested := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/")
+		if err == nil {
+			resp.Body.Close()
+		}
+		requested <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	client, err := NewClient(socket)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	reply, err := client.Send("KICK", mode, "2s")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	var result KickResult
+	if err := json.Unmarshal([]byte(reply), &result); err != nil {
+		t.Logf("bad reply %q: %v", reply, err)
+		t.FailNow()
+	}
+	if result.Mode != mode || result.PID != os.Getpid() || result.Open != 1 {
+		t.Logf("unexpected result: %+v", result)
+		t.FailNow()
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Log("wanted socket removed before reply, got:", err)
+		t.FailNow()
+	}
+
+	select {
+	case <-wait(srv):
+	case <-time.After(3 * time.Second):
+		t.Log("kicked server did not reach runlevel 0")
+		t.FailNow()
+	}
+	return &result, <-requested
+}
+
+func wait(srv *System) chan int {
+	c := make(chan int, 1)
+	go func() { c <- srv.Wait() }()
+	return c
+}
+
+func TestKickImmediate(t *testing.T) {
+	result, err := kickSlow(t, "127.0.0.1:30103", KickImmediate)
+	if err == nil {
+		t.Log("wanted open request to be cut")
+		t.FailNow()
+	}
+	if result.Closed != 1 {
+		t.Logf("wanted 1 connection closed, got %+v", result)
+		t.FailNow()
+	}
+}
+
+func TestKickDrain(t *testing.T) {
+	result, err := kickSlow(t, "127.0.0.1:30104", KickDrain)
+	if err != nil {
+		t.Log("wanted open request to finish, got:", err)
+		t.FailNow()
+	}
+	if result.Drained != 1 || result.Closed != 0 || result.Took < 100*time.Millisecond {
+		t.Logf("wanted 1 connection drained, got %+v", result)
+		t.FailNow()
+	}
+}
+
+func TestKickHandoff(t *testing.T) {
+	result, err := kickSlow(t, "127.0.0.1:30105", KickHandoff)
+	if err != nil {
+		t.Log("wanted open request to finish, got:", err)
+		t.FailNow()
+	}
+	if result.Drained != 0 || result.Took > 100*time.Millisecond {
+		t.Logf("wanted reply before draining, got %+v", result)
+		t.FailNow()
+	}
+}
+
+func TestKickBadMode(t *testing.T) {
+	for _, arg := range []string{"later", "drain soon", "drain 1s 2s"} {
+		if _, _, err := parseKick(arg); err == nil {
+			t.Logf("wanted error parsing KICK %q", arg)
+			t.FailNow()
+		}
+	}
+	if mode, d, err := parseKick("DRAIN 5s"); err != nil || mode != KickDrain || d != 5*time.Second {
+		t.Logf("parsing KICK DRAIN 5s, got %q %v %v", mode, d, err)
+		t.FailNow()
+	}
+}
@@ -1,17 +1,19 @@
 package diamond
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	"strings"
+	"sync/atomic"
 )
 
 func (s *System) closelisteners() error {
 	var errors = make(chan error, len(s.listeners))
 	var nl int = len(s.listeners)
 	for i := 0; i < nl; i++ {
-		s.Log.Println("closing listener:", s.listeners[i].String())
+		s.event("closing listener: %s", s.listeners[i].String())
 		go func(name string, listener net.Listener) {
 			if listener == nil {
 				errors <- nil
@@ -37,11 +39,16 @@ func (s *System) closelisteners() error {
 				continue
 			}
 
-			s.Log.Println(err)
+			s.log(LevelError, "error closing listener", FieldError, err)
 			nerr++
 		}
 	}
 
+	for i := 0; i < nl; i++ {
+		s.listeners[i].listener = nil
+		s.listeners[i].tls = nil
+	}
+
 	if nerr == 0 || s.Config.Force {
 		return nil
 	}
@@ -52,36 +59,16 @@ func (s *System) closelisteners() error {
 func (s *System) openlisteners() error {
 	var errors = []error{}
 
+	// use sockets passed in by systemd
+	s.claimActivated()
+
 	// open listener
 	for i := range s.listeners {
-		s.Log.Printf("opening %q listener on %q", s.listeners[i].ltype, s.listeners[i].laddr)
-		str := s.listeners[i].ltype
-		switch str {
-		default:
-			s.Log.Println(str)
-			panic("Listener type incorrect: tcp, unix, tls, got:" + s.listeners[i].ltype)
-		// tls
-		case "tls":
-			panic("no tls, sorry")
-		// tcp or unix socket
-		case "tcp", "unix":
-			l, err := net.Listen(s.listeners[i].ltype, s.listeners[i].laddr)
-			if err != nil {
-				s.Log.Printf("error opening %s (%s): %v", s.listeners[i].laddr, s.listeners[i].ltype, err)
-				errors = append(errors, err)
-			} else {
-				s.listeners[i].listener = l
-				s.Log.Printf("now able to listen (%s) on %s", s.listeners[i].ltype, s.listeners[i].laddr)
-				s.Log.Printf("serving http on %s", s.listeners[i].laddr)
-				go func(li net.Listener, laddr string) {
-
-					s.Server.Serve(li)
-					if err != nil {
-						s.Log.Printf("no longer serving http on %s: %s", laddr, err.Error())
-					}
-				}(l, s.listeners[i].laddr)
-			}
-
+		if s.listeners[i].listener != nil {
+			continue // still open, such as from runlevel 3 to 4
+		}
+		if err := s.openListener(s.listeners[i]); err != nil {
+			errors = append(errors, err)
 		}
 	}
 
@@ -92,31 +79,82 @@ func (s *System) openlisteners() error {
 	return fmt.Errorf("%v errors, check log for details.", len(errors))
 }
 
+// openListener listens on l and serves http
+func (s *System) openListener(l *listener) (err error) {
+	s.log(LevelDebug, "opening "+l.ltype+" listener", FieldListener, l.laddr)
+	var cert *tls.Certificate
+	if l.ltype == "tls" {
+		cert, err = loadCert(l)
+	}
+	var ln net.Listener
+	if err == nil {
+		ln, err = s.listen(l)
+	}
+	if err != nil {
+		s.event("error opening %s (%s): %v", l.laddr, l.ltype, err)
+		return err
+	}
+	s.serve(l, ln, cert)
+	return nil
+}
+
+// listen opens the socket of l, or a copy of the one passed in
+func (s *System) listen(l *listener) (net.Listener, error) {
+	switch l.ltype {
+	default:
+		panic("Listener type incorrect: tcp, unix, tls, got:" + l.ltype)
+	// tcp, https or unix socket
+	case "tcp", "unix", "tls":
+	}
+	if l.file != nil {
+		return net.FileListener(l.file) // a copy, systemd keeps the original
+	}
+	return net.Listen(network(l.ltype), l.laddr)
+}
+
+// serve http on ln, the socket of l, with cert for tls listeners
+func (s *System) serve(l *listener, ln net.Listener, cert *tls.Certificate) {
+	var served net.Listener = &countedListener{Listener: ln, c: l.counters}
+	if cert != nil {
+		l.tls = s.serveTLS(served, cert)
+		served = l.tls
+	}
+	l.listener = ln
+	s.event("listening (%s) on %s", l.ltype, l.laddr)
+	go func(laddr string) {
+		err := s.Server.Serve(served)
+		s.log(LevelDebug, "no longer serving http", FieldListener, laddr, FieldError, err)
+	}(l.laddr)
+}
+
 // ConnState closes idle connections, while counting  active connections
 // so they don't hang open while switching to runlevel 1
 func (s *System) connState(c net.Conn, state http.ConnState) {
-	if s.Config.Verbose {
-		s.Log.Println(state, c.LocalAddr(), c.RemoteAddr())
+	s.log(LevelDebug, state.String(), FieldListener, c.LocalAddr(), FieldPeer, c.RemoteAddr())
+	if cc := s.countedOf(c); cc != nil {
+		cc.count(state)
+		if state == http.StateClosed || state == http.StateHijacked {
+			s.tlsConns.Delete(c)
+		}
 	}
 	switch state {
-	case http.StateActive: // increment counters
-		//go s.counters.Up("total", "active")
+	case http.StateActive:
+	case http.StateHijacked:
+		atomic.AddInt64(&s.conns, -1)
 	case http.StateClosed:
-		//go func() { // make the active connections counter a little less boring
-		//	<-time.After(durationactive)
-		//	s.counters.Down("active")
-		//}()
+		atomic.AddInt64(&s.conns, -1)
 		e := c.Close() // dont wait around to close a connection
 		if e != nil {
-			s.Log.Println(e)
+			s.log(LevelDebug, "error closing connection", FieldPeer, c.RemoteAddr(), FieldError, e)
 		}
 	case http.StateIdle:
 		e := c.Close() // dont wait around for stale clients to close a connection
 		if e != nil {
-			s.Log.Println(e)
+			s.log(LevelDebug, "error closing connection", FieldPeer, c.RemoteAddr(), FieldError, e)
 		}
 	case http.StateNew:
+		atomic.AddInt64(&s.conns, 1)
 	default:
-		s.Log.Println("Got new alien state:", state.String())
+		s.log(LevelWarn, "unknown connection state "+state.String(), FieldPeer, c.RemoteAddr())
 	}
 }
@@ -0,0 +1,206 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message, with the same values as log/slog
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (l Level) String() string {
+	switch {
+	case l < LevelInfo:
+		return "DEBUG"
+	case l < LevelWarn:
+		return "INFO"
+	case l < LevelError:
+		return "WARN"
+	default:
+		return "ERROR"
+	}
+}
+
+// Keys of the fields given with log messages
+const (
+	FieldRunlevel = "runlevel"
+	FieldListener = "listener"
+	FieldPeer     = "peer"
+	FieldCommand  = "command"
+	FieldDuration = "duration"
+	FieldError    = "error"
+)
+
+// Logger receives log messages, with fields as key/value pairs, such as
+//
+//	Log(LevelInfo, "listening", FieldListener, "127.0.0.1:8080")
+type Logger interface {
+	Log(level Level, msg string, fields ...interface{})
+}
+
+type loggerBox struct {
+	Logger
+}
+
+// SetLogger sends log messages to l, instead of text to s.Log.
+// Debug messages are only sent with Options.Verbose.
+func (s *System) SetLogger(l Logger) {
+	s.logger.Store(loggerBox{l})
+}
+
+// log sends a message to the logger, if Options.Verbose allows its level
+func (s *System) log(level Level, msg string, fields ...interface{}) {
+	s.output(1, level, msg, fields...)
+}
+
+// output is log, called depth frames below the call site to report
+func (s *System) output(depth int, level Level, msg string, fields ...interface{}) {
+	if level < LevelInfo && !s.Config.Verbose {
+		return
+	}
+	if box, ok := s.logger.Load().(loggerBox); ok && box.Logger != nil {
+		box.Log(level, msg, fields...)
+		return
+	}
+	TextLoggerDepth(s.Log, depth+1).Log(level, msg, fields...)
+}
+
+// fieldValue is how values are written by TextLogger and JSONLogger
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+// pairs calls fn for each key and value, as log/slog does with an odd one out
+func pairs(fields []interface{}, fn func(key string, value interface{})) {
+	for i := 0; i < len(fields); i += 2 {
+		if i+1 == len(fields) {
+			fn("!BADKEY", fields[i])
+			return
+		}
+		key, ok := fields[i].(string)
+		if !ok {
+			key = fmt.Sprint(fields[i])
+		}
+		fn(key, fieldValue(fields[i+1]))
+	}
+}
+
+type textLogger struct {
+	l     *log.Logger
+	depth int
+}
+
+// TextLogger writes messages to l as text, such as
+//
+//	WARN watchdog error="connection refused"
+//
+// with no prefix for LevelInfo.
+func TextLogger(l *log.Logger) Logger {
+	return textLogger{l, 0}
+}
+
+// TextLoggerDepth is TextLogger for use in a wrapper, depth frames below
+// the call site that log.Lshortfile and log.Llongfile should report
+func TextLoggerDepth(l *log.Logger, depth int) Logger {
+	return textLogger{l, depth}
+}
+
+func (t textLogger) Log(level Level, msg string, fields ...interface{}) {
+	var b strings.Builder
+	if level != LevelInfo {
+		b.WriteString(level.String())
+		b.WriteByte(' ')
+	}
+	b.WriteString(msg)
+	pairs(fields, func(key string, value interface{}) {
+		s := fmt.Sprintf("%+v", value)
+		if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+			s = strconv.Quote(s)
+		}
+		b.WriteString(" " + key + "=" + s)
+	})
+	t.l.Output(2+t.depth, b.String())
+}
+
+type jsonLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// JSONLogger writes one JSON object per line to w, with the time,
+// level and msg, followed by the fields in order
+func JSONLogger(w io.Writer) Logger {
+	return &jsonLogger{w: w}
+}
+
+func (j *jsonLogger) Log(level Level, msg string, fields ...interface{}) {
+	var b strings.Builder
+	write := func(key string, value interface{}) {
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(value)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(value))
+		}
+		if b.Len() == 0 {
+			b.WriteByte('{')
+		} else {
+			b.WriteByte(',')
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	write("time", time.Now().Format(time.RFC3339Nano))
+	write("level", level.String())
+	write("msg", msg)
+	pairs(fields, write)
+	b.WriteString("}\n")
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	io.WriteString(j.w, b.String())
+}
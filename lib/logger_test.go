@@ -0,0 +1,175 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type logged struct {
+	level  Level
+	msg    string
+	fields map[string]interface{}
+}
+
+type testLogger struct {
+	mu   sync.Mutex
+	logs []logged
+}
+
+func (t *testLogger) Log(level Level, msg string, fields ...interface{}) {
+	m := make(map[string]interface{})
+	pairs(fields, func(k string, v interface{}) { m[k] = v })
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.logs = append(t.logs, logged{level, msg, m})
+}
+
+func (t *testLogger) find(msg string) *logged {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.logs {
+		if t.logs[i].msg == msg {
+			return &t.logs[i]
+		}
+	}
+	return nil
+}
+
+func TestTextLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := TextLogger(log.New(&buf, "", 0))
+	l.Log(LevelInfo, "listening", FieldListener, "127.0.0.1:80")
+	l.Log(LevelWarn, "watchdog", FieldError, fmt.Errorf("no answer"), FieldDuration, time.Second, "odd")
+	want := "listening listener=127.0.0.1:80\n" +
+		`WARN watchdog error="no answer" duration=1s !BADKEY=odd` + "\n"
+	if buf.String() != want {
+		t.Logf("expected %q, got %q", want, buf.String())
+		t.FailNow()
+	}
+}
+
+func TestTextLoggerCaller(t *testing.T) {
+	var buf bytes.Buffer
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	srv.Log = log.New(&buf, "", log.Lshortfile)
+	TextLogger(srv.Log).Log(LevelInfo, "direct")
+	srv.log(LevelInfo, "log")
+	srv.event("event")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Logf("expected 3 lines, got %q", buf.String())
+		t.FailNow()
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "logger_test.go:") {
+			t.Logf("expected the caller's file, got %q", line)
+			t.FailNow()
+		}
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := JSONLogger(&buf)
+	l.Log(LevelError, "runlevel 1 -> 3 failed", FieldRunlevel, 1, FieldDuration, time.Millisecond, FieldError, fmt.Errorf("busy"))
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if got["level"] != "ERROR" || got["msg"] != "runlevel 1 -> 3 failed" || got["runlevel"] != 1.0 ||
+		got["duration"] != "1ms" || got["error"] != "busy" || got["time"] == nil {
+		t.Logf("unexpected json log: %s", buf.String())
+		t.FailNow()
+	}
+	if !strings.HasPrefix(buf.String(), `{"time":`) || !strings.HasSuffix(buf.String(), "}\n") {
+		t.Logf("expected time first and one line, got %q", buf.String())
+		t.FailNow()
+	}
+}
+
+func TestLoggerVerbose(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	logs := new(testLogger)
+	srv.SetLogger(logs)
+	srv.log(LevelDebug, "hidden")
+	srv.log(LevelInfo, "shown")
+	srv.Config.Verbose = true
+	srv.log(LevelDebug, "verbose")
+	if logs.find("hidden") != nil || logs.find("shown") == nil || logs.find("verbose") == nil {
+		t.Logf("wrong messages filtered: %+v", logs.logs)
+		t.FailNow()
+	}
+}
+
+func TestLoggerCommands(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	logs := new(testLogger)
+	srv.SetLogger(logs)
+	client, err := NewClient(socket)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	client.Token = "secret"
+	client.Name = "tester"
+	if _, err := client.Send("echo", "hi"); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	time.Sleep(100 * time.Millisecond)
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+	var echo bool
+	for _, l := range logs.logs {
+		if strings.Contains(fmt.Sprint(l.fields), "secret") {
+			t.Logf("token was logged: %+v", l)
+			t.FailNow()
+		}
+		if l.msg == "command" && l.fields[FieldCommand] == "ECHO hi" {
+			echo = true
+			if l.fields[FieldPeer] != "tester" || l.fields[FieldDuration] == nil {
+				t.Logf("expected peer and duration: %+v", l)
+				t.FailNow()
+			}
+		}
+	}
+	if !echo {
+		t.Logf("ECHO was not logged: %+v", logs.logs)
+		t.FailNow()
+	}
+}
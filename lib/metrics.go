@@ -0,0 +1,280 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MetricsBuckets are the upper bounds, in seconds, of the runlevel
+// transition duration histogram
+var MetricsBuckets = []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 30}
+
+// metrics are always collected, and served by ServeMetrics
+type metrics struct {
+	mu          sync.Mutex
+	level       int
+	transitions map[transitionKey]*transitionMetrics
+	commands    map[command]int64
+	listeners   []listenerMetric // snapshot, so scraping never waits for a transition
+	listener    net.Listener     // see ServeMetrics
+	server      *http.Server
+}
+
+type transitionKey struct {
+	from, to int
+}
+
+type transitionMetrics struct {
+	count, failures int64
+	seconds         float64
+	buckets         []int64 // for each of MetricsBuckets
+}
+
+type command struct {
+	name, result string
+}
+
+type listenerMetric struct {
+	name, ltype, addr string
+	open              bool
+	c                 *counters
+}
+
+// transition records a runlevel transition (or attempt)
+func (m *metrics) transition(from, to, level int, took time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.transitions == nil {
+		m.transitions = make(map[transitionKey]*transitionMetrics)
+	}
+	t := m.transitions[transitionKey{from, to}]
+	if t == nil {
+		t = &transitionMetrics{buckets: make([]int64, len(MetricsBuckets))}
+		m.transitions[transitionKey{from, to}] = t
+	}
+	t.count++
+	if err != nil {
+		t.failures++
+	}
+	seconds := took.Seconds()
+	t.seconds += seconds
+	for i, le := range MetricsBuckets {
+		if seconds <= le {
+			t.buckets[i]++
+		}
+	}
+	m.level = level
+}
+
+// command records a control socket command, such as "Diamond.RUNLEVEL"
+func (m *metrics) command(method, errmsg string) {
+	name := strings.ToLower(strings.TrimPrefix(method, "Diamond."))
+	result := "ok"
+	if errmsg != "" {
+		result = "error"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.commands == nil {
+		m.commands = make(map[command]int64)
+	}
+	m.commands[command{name, result}]++
+}
+
+// setListeners takes a snapshot of the listeners. Caller holds locklevel.
+func (m *metrics) setListeners(listeners []*listener) {
+	snapshot := make([]listenerMetric, len(listeners))
+	for i, l := range listeners {
+		snapshot[i] = listenerMetric{l.name, l.ltype, l.laddr, l.listener != nil, l.counters}
+	}
+	m.mu.Lock()
+	m.listeners = snapshot
+	m.mu.Unlock()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats pairs of label names and values
+func labels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func header(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// WriteMetrics writes all metrics in the Prometheus text exposition format
+func (s *System) WriteMetrics(w io.Writer) {
+	m := &s.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	header(w, "diamond_runlevel", "gauge", "Current runlevel.")
+	fmt.Fprintf(w, "diamond_runlevel %d\n", m.level)
+	header(w, "diamond_start_time_seconds", "gauge", "When the system was created, in seconds since the epoch.")
+	fmt.Fprintf(w, "diamond_start_time_seconds %d\n", s.started.Unix())
+
+	var keys []transitionKey
+	for k := range m.transitions {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].from < keys[j].from || keys[i].from == keys[j].from && keys[i].to < keys[j].to
+	})
+	header(w, "diamond_runlevel_transitions_total", "counter", "Runlevel transitions attempted, by from and to level.")
+	for _, k := range keys {
+		fmt.Fprintf(w, "diamond_runlevel_transitions_total%s %d\n", labels("from", strconv.Itoa(k.from), "to", strconv.Itoa(k.to)), m.transitions[k].count)
+	}
+	header(w, "diamond_runlevel_transition_failures_total", "counter", "Runlevel transitions that failed, by from and to level.")
+	for _, k := range keys {
+		fmt.Fprintf(w, "diamond_runlevel_transition_failures_total%s %d\n", labels("from", strconv.Itoa(k.from), "to", strconv.Itoa(k.to)), m.transitions[k].failures)
+	}
+	header(w, "diamond_runlevel_transition_duration_seconds", "histogram", "Time taken by runlevel transitions, by from and to level.")
+	for _, k := range keys {
+		t := m.transitions[k]
+		from, to := strconv.Itoa(k.from), strconv.Itoa(k.to)
+		for i, le := range MetricsBuckets {
+			fmt.Fprintf(w, "diamond_runlevel_transition_duration_seconds_bucket%s %d\n",
+				labels("from", from, "to", to, "le", strconv.FormatFloat(le, 'g', -1, 64)), t.buckets[i])
+		}
+		fmt.Fprintf(w, "diamond_runlevel_transition_duration_seconds_bucket%s %d\n", labels("from", from, "to", to, "le", "+Inf"), t.count)
+		fmt.Fprintf(w, "diamond_runlevel_transition_duration_seconds_sum%s %g\n", labels("from", from, "to", to), t.seconds)
+		fmt.Fprintf(w, "diamond_runlevel_transition_duration_seconds_count%s %d\n", labels("from", from, "to", to), t.count)
+	}
+
+	header(w, "diamond_connections", "gauge", "Open http connections, on all listeners.")
+	fmt.Fprintf(w, "diamond_connections %d\n", atomic.LoadInt64(&s.conns))
+	for _, metric := range []struct {
+		name, typ, help string
+		value           func(l listenerMetric) int64
+	}{
+		{"diamond_listener_open", "gauge", "Whether the listener is open.", func(l listenerMetric) int64 {
+			if l.open {
+				return 1
+			}
+			return 0
+		}},
+		{"diamond_listener_active_connections", "gauge", "Connections handling a request.", func(l listenerMetric) int64 { return atomic.LoadInt64(&l.c.active) }},
+		{"diamond_listener_idle_connections", "gauge", "Connections waiting for another request.", func(l listenerMetric) int64 { return atomic.LoadInt64(&l.c.idle) }},
+		{"diamond_listener_accepted_total", "counter", "Connections accepted.", func(l listenerMetric) int64 { return atomic.LoadInt64(&l.c.accepted) }},
+		{"diamond_listener_closed_total", "counter", "Connections closed.", func(l listenerMetric) int64 { return atomic.LoadInt64(&l.c.closed) }},
+		{"diamond_listener_read_bytes_total", "counter", "Bytes read from connections.", func(l listenerMetric) int64 { return atomic.LoadInt64(&l.c.in) }},
+		{"diamond_listener_written_bytes_total", "counter", "Bytes written to connections.", func(l listenerMetric) int64 { return atomic.LoadInt64(&l.c.out) }},
+	} {
+		header(w, metric.name, metric.typ, metric.help)
+		for _, l := range m.listeners {
+			fmt.Fprintf(w, "%s%s %d\n", metric.name, labels("name", l.name, "type", l.ltype, "addr", l.addr), metric.value(l))
+		}
+	}
+
+	var cmds []command
+	for k := range m.commands {
+		cmds = append(cmds, k)
+	}
+	sort.Slice(cmds, func(i, j int) bool {
+		return cmds[i].name < cmds[j].name || cmds[i].name == cmds[j].name && cmds[i].result < cmds[j].result
+	})
+	header(w, "diamond_control_commands_total", "counter", "Control socket commands, by command and result.")
+	for _, k := range cmds {
+		fmt.Fprintf(w, "diamond_control_commands_total%s %d\n", labels("command", k.name, "result", k.result), m.commands[k])
+	}
+}
+
+// MetricsHandler serves WriteMetrics, for mounting on another server
+func (s *System) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.WriteMetrics(w)
+	})
+}
+
+// ServeMetrics serves metrics at /metrics on a dedicated listener (such as
+// "tcp", ":9100"), which stays open in every runlevel but 0. A matching
+// socket from systemd, or passed by Upgrade, is used if there is one.
+func (s *System) ServeMetrics(ltype, laddr string) error {
+	s.locklevel.Lock()
+	defer s.locklevel.Unlock()
+	m := &s.metrics
+	if m.listener != nil {
+		return fmt.Errorf("already serving metrics on %s", m.listener.Addr())
+	}
+	var l net.Listener
+	var err error
+	want := &listener{ltype: ltype, laddr: laddr}
+	for _, a := range s.activated {
+		if !a.claimed && a.matches(want) {
+			a.claimed = true
+			l, err = net.FileListener(a.file)
+			break
+		}
+	}
+	if l == nil && err == nil {
+		l, err = net.Listen(ltype, laddr)
+	}
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.MetricsHandler())
+	m.listener = l
+	m.server = &http.Server{Handler: mux}
+	go m.server.Serve(l)
+	s.event("serving metrics (%s) on %s", ltype, laddr)
+	return nil
+}
+
+// closeMetrics closes the metrics listener, if any. Caller holds locklevel.
+func (s *System) closeMetrics() {
+	m := &s.metrics
+	if m.server == nil {
+		return
+	}
+	if s.handedoff {
+		if l, ok := m.listener.(*net.UnixListener); ok {
+			l.SetUnlinkOnClose(false)
+		}
+	}
+	m.server.Close()
+	m.server, m.listener = nil, nil
+}
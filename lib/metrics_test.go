@@ -0,0 +1,124 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T, addr string) string {
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return string(b)
+}
+
+func TestMetrics(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	addr := "127.0.0.1:30109"
+	defer srv.Runlevel(0)
+	srv.AddNamedListener("web", "tcp", "127.0.0.1:30110")
+	if err := srv.ServeMetrics("tcp", addr); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if err := srv.ServeMetrics("tcp", addr); err == nil {
+		t.Log("expected error serving metrics twice")
+		t.FailNow()
+	}
+	srv.SetRunlevel(2, func() error { return fmt.Errorf("no") })
+	if err := srv.Runlevel(3); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if err := srv.Runlevel(2); err == nil {
+		t.Log("expected runlevel 2 to fail")
+		t.FailNow()
+	}
+	client, err := NewClient(socket)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	client.Send("echo", "hi")
+	client.Send("runlevel", "9")
+
+	got := scrape(t, addr)
+	if strings.Contains(got, `to="9"`) {
+		t.Logf("unexpected metrics for runlevel 9:\n%s", got)
+		t.FailNow()
+	}
+	for _, want := range []string{
+		"diamond_runlevel 3\n",
+		`diamond_runlevel_transitions_total{from="3",to="2"} 1` + "\n",
+		`diamond_runlevel_transition_failures_total{from="3",to="2"} 1` + "\n",
+		`diamond_runlevel_transition_failures_total{from="0",to="3"} 0` + "\n",
+		`diamond_runlevel_transition_duration_seconds_bucket{from="0",to="3",le="+Inf"} 1` + "\n",
+		`diamond_runlevel_transition_duration_seconds_count{from="0",to="3"} 1` + "\n",
+		`diamond_listener_open{name="web",type="tcp",addr="127.0.0.1:30110"} 1` + "\n",
+		`diamond_listener_active_connections{name="web",type="tcp",addr="127.0.0.1:30110"} 0` + "\n",
+		`diamond_control_commands_total{command="echo",result="ok"} 1` + "\n",
+		`diamond_control_commands_total{command="runlevel",result="error"} 1` + "\n",
+		"# TYPE diamond_runlevel_transition_duration_seconds histogram\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Logf("expected %q in metrics:\n%s", want, got)
+			t.FailNow()
+		}
+	}
+
+	// still served in runlevel 1
+	if err := srv.Runlevel(1); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	got = scrape(t, addr)
+	for _, want := range []string{
+		"diamond_runlevel 1\n",
+		`diamond_listener_open{name="web",type="tcp",addr="127.0.0.1:30110"} 0` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Logf("expected %q in metrics:\n%s", want, got)
+			t.FailNow()
+		}
+	}
+
+	// closed in runlevel 0
+	srv.Runlevel(0)
+	if _, err := http.Get("http://" + addr + "/metrics"); err == nil {
+		t.Log("expected metrics to be closed in runlevel 0")
+		t.FailNow()
+	}
+}
@@ -0,0 +1,226 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// NamedRunlevel gives a runlevel a name, and any aliases, for people
+type NamedRunlevel struct {
+	Level       int
+	Name        string
+	Aliases     []string `json:",omitempty"`
+	Description string   `json:",omitempty"`
+}
+
+// DefaultRunlevelNames name the built in runlevels, and runlevel 2 for
+// programs using it (see SetRunlevel). Change them with NameRunlevel.
+var DefaultRunlevelNames = []NamedRunlevel{
+	{0, "halt", []string{"shutdown"}, "stopped, control socket removed"},
+	{1, "maintenance", []string{"single"}, "all listeners closed"},
+	{2, "readonly", nil, "defined by the program"},
+	{3, "serving", []string{"multiuser"}, "all listeners open"},
+	{4, "debug", nil, "serving, with pprof and expvar on the debug socket"},
+}
+
+// runlevelNames are the names of a System's runlevels
+type runlevelNames struct {
+	mu      sync.Mutex
+	byLevel map[int]NamedRunlevel
+}
+
+// defaultNames is DefaultRunlevelNames by level, for a new System
+func defaultNames() map[int]NamedRunlevel {
+	m := make(map[int]NamedRunlevel)
+	for _, v := range DefaultRunlevelNames {
+		m[v.Level] = v
+	}
+	return m
+}
+
+// name of level, or "" if it has none
+func (n *runlevelNames) name(level int) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.byLevel[level].Name
+}
+
+// lookup a name or alias, in any case
+func (n *runlevelNames) lookup(name string) (int, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for level, v := range n.byLevel {
+		if v.is(name) {
+			return level, true
+		}
+	}
+	return 0, false
+}
+
+// is true if name is the name or an alias of r, in any case
+func (r NamedRunlevel) is(name string) bool {
+	if strings.EqualFold(r.Name, name) {
+		return true
+	}
+	for _, alias := range r.Aliases {
+		if strings.EqualFold(alias, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// NameRunlevel sets the name, aliases and description of r.Level,
+// replacing any it had. Names must not be numbers, or taken by another level.
+func (s *System) NameRunlevel(r NamedRunlevel) error {
+	names := append([]string{r.Name}, r.Aliases...)
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name, " \t\n") {
+			return fmt.Errorf("runlevel %d: bad name %q", r.Level, name)
+		}
+		if _, err := strconv.Atoi(name); err == nil {
+			return fmt.Errorf("runlevel %d: name %q is a number", r.Level, name)
+		}
+		if level, ok := s.names.lookup(name); ok && level != r.Level {
+			return fmt.Errorf("runlevel %d: name %q is runlevel %d", r.Level, name, level)
+		}
+	}
+	r.Aliases = append([]string(nil), r.Aliases...)
+	s.names.mu.Lock()
+	s.names.byLevel[r.Level] = r
+	s.names.mu.Unlock()
+	return nil
+}
+
+// RunlevelNames returns the names of the runlevels that exist, the built
+// in ones and those set with SetRunlevel, by level
+func (s *System) RunlevelNames() []NamedRunlevel {
+	s.locklevel.Lock()
+	exists := make(map[int]bool)
+	for level := range s.runlevels {
+		exists[level] = true
+	}
+	s.locklevel.Unlock()
+	s.names.mu.Lock()
+	defer s.names.mu.Unlock()
+	var names []NamedRunlevel
+	for level, v := range s.names.byLevel {
+		if exists[level] || level >= 0 && level <= 4 && level != 2 {
+			names = append(names, v)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i].Level < names[j].Level })
+	return names
+}
+
+// ParseRunlevel reads a runlevel as a number, or a name or alias such as
+// "serving", in any case
+func (s *System) ParseRunlevel(arg string) (int, error) {
+	if level, err := strconv.Atoi(arg); err == nil {
+		return level, nil
+	}
+	if level, ok := s.names.lookup(arg); ok {
+		return level, nil
+	}
+	return 0, fmt.Errorf("no runlevel named %q", arg)
+}
+
+// ParseRunlevel reads a runlevel as a number, or a name or alias from
+// DefaultRunlevelNames, in any case. It is System.ParseRunlevel for
+// servers without a System, such as the root diamond package.
+func ParseRunlevel(arg string) (int, error) {
+	if level, err := strconv.Atoi(arg); err == nil {
+		return level, nil
+	}
+	for _, v := range DefaultRunlevelNames {
+		if v.is(arg) {
+			return v.Level, nil
+		}
+	}
+	return 0, fmt.Errorf("no runlevel named %q", arg)
+}
+
+// RunlevelNamed is Runlevel, with a name such as "maintenance" or a number
+func (s *System) RunlevelNamed(name string) error {
+	level, err := s.ParseRunlevel(name)
+	if err != nil {
+		return err
+	}
+	return s.Runlevel(level)
+}
+
+// Runlevels replies with the names of the runlevels that exist, as JSON
+func (p *packet) Runlevels(arg string, reply *string) error {
+	b, err := json.Marshal(p.parent.RunlevelNames())
+	if err != nil {
+		*reply = "error"
+		return err
+	}
+	*reply = string(b)
+	return nil
+}
+
+func (p *packet) RUNLEVELS(arg string, reply *string) error {
+	return p.Runlevels(arg, reply)
+}
+
+// Runlevels sends the RUNLEVELS command, returning the server's runlevel names
+func (c *Client) Runlevels() ([]NamedRunlevel, error) {
+	reply, err := c.Send("RUNLEVELS")
+	if err != nil {
+		return nil, err
+	}
+	var names []NamedRunlevel
+	if err := json.Unmarshal([]byte(reply), &names); err != nil {
+		return nil, fmt.Errorf("bad runlevels reply: %v", err)
+	}
+	return names, nil
+}
+
+// ParseRunlevel reads a runlevel as a number, or a name or alias known
+// to the server
+func (c *Client) ParseRunlevel(arg string) (int, error) {
+	if level, err := strconv.Atoi(arg); err == nil {
+		return level, nil
+	}
+	names, err := c.Runlevels()
+	if err != nil {
+		return 0, err
+	}
+	for _, v := range names {
+		for _, name := range append([]string{v.Name}, v.Aliases...) {
+			if strings.EqualFold(name, arg) {
+				return v.Level, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no runlevel named %q", arg)
+}
@@ -0,0 +1,137 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRunlevelNames(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	for _, arg := range []string{"serving", "Serving", "multiuser", "3"} {
+		if level, err := srv.ParseRunlevel(arg); err != nil || level != 3 {
+			t.Logf("expected %q to be runlevel 3, got %d %v", arg, level, err)
+			t.FailNow()
+		}
+	}
+	if _, err := srv.ParseRunlevel("warp"); err == nil {
+		t.Log("expected error for an unknown name")
+		t.FailNow()
+	}
+	for _, bad := range []NamedRunlevel{
+		{Level: 5, Name: "serving"},
+		{Level: 5, Name: "5"},
+		{Level: 5, Name: "canary", Aliases: []string{""}},
+	} {
+		if err := srv.NameRunlevel(bad); err == nil {
+			t.Logf("expected error naming %+v", bad)
+			t.FailNow()
+		}
+	}
+	srv.SetRunlevel(5, func() error { return nil })
+	if err := srv.NameRunlevel(NamedRunlevel{Level: 5, Name: "canary", Aliases: []string{"5%"}, Description: "some traffic"}); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	names := srv.RunlevelNames()
+	var got []string
+	for _, n := range names {
+		got = append(got, n.Name)
+	}
+	if len(got) != 5 || got[0] != "halt" || got[1] != "maintenance" || got[3] != "debug" || got[4] != "canary" {
+		t.Logf("expected names of existing runlevels, got %v", got)
+		t.FailNow()
+	}
+
+	// names over the control socket
+	client, err := NewClient(socket)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if _, err := client.Send("runlevel", "5%"); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	st, err := client.Status()
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if st.Level != 5 || st.LevelName != "canary" {
+		t.Logf("expected runlevel 5 (canary), got %d (%s)", st.Level, st.LevelName)
+		t.FailNow()
+	}
+	if level, err := client.ParseRunlevel("MAINTENANCE"); err != nil || level != 1 {
+		t.Logf("expected maintenance to be runlevel 1, got %d %v", level, err)
+		t.FailNow()
+	}
+	if _, err := client.Send("runlevel", "warp"); err == nil {
+		t.Log("expected error for an unknown name")
+		t.FailNow()
+	}
+	if err := srv.RunlevelNamed("maintenance"); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if level := srv.GetRunlevel(); level != 1 {
+		t.Logf("expected runlevel 1, got %d", level)
+		t.FailNow()
+	}
+}
+
+func TestConfigRunlevelName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diamond-config")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	c, err := LoadConfig(writeConfig(t, dir, "c.toml", "socket = \"s\"\nrunlevel = \"debug\""))
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if c.Runlevel != 4 {
+		t.Logf("expected runlevel 4, got %d", c.Runlevel)
+		t.FailNow()
+	}
+}
+
+func TestParseRunlevelDefault(t *testing.T) {
+	for arg, want := range map[string]int{"maintenance": 1, "SINGLE": 1, "halt": 0, "serving": 3, "4": 4} {
+		if level, err := ParseRunlevel(arg); err != nil || level != want {
+			t.Logf("expected %q to be runlevel %d, got %d %v", arg, want, level, err)
+			t.FailNow()
+		}
+	}
+	if _, err := ParseRunlevel("warp"); err == nil {
+		t.Log("expected error for an unknown name")
+		t.FailNow()
+	}
+}
@@ -0,0 +1,68 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"fmt"
+	"os"
+)
+
+// pidFilePath is next to the control socket
+func pidFilePath(socket string) string {
+	return socket + ".pid"
+}
+
+// LockPIDFile creates a pid file next to the control socket (socket + ".pid")
+// and holds a lock on it until runlevel 0, so no other instance can start
+// on the same socket, even if the socket file is deleted.
+func (s *System) LockPIDFile() error {
+	s.locklevel.Lock()
+	defer s.locklevel.Unlock()
+	if s.pidfile != nil {
+		return nil
+	}
+	f, pid, err := lockFile(pidFilePath(s.controlSocket))
+	if err != nil {
+		if pid != 0 {
+			return fmt.Errorf("already running as pid %d", pid)
+		}
+		return err
+	}
+	s.pidfile = f
+	return nil
+}
+
+// removePIDFile unlocks and removes the pid file, if any
+func (s *System) removePIDFile() {
+	if s.pidfile == nil {
+		return
+	}
+	s.log(LevelDebug, "removing pid file")
+	if err := os.Remove(s.pidfile.Name()); err != nil {
+		s.log(LevelWarn, "error removing pid file", FieldError, err)
+	}
+	s.pidfile.Close()
+	s.pidfile = nil
+}
@@ -0,0 +1,72 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPIDFile(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	if err := srv.LockPIDFile(); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	b, err := ioutil.ReadFile(socket + ".pid")
+	if err != nil || strings.TrimSpace(string(b)) != strconv.Itoa(os.Getpid()) {
+		t.Logf("wanted our pid in pid file, got %q %v", b, err)
+		t.FailNow()
+	}
+	if st := srv.Status(); st.PIDFile != socket+".pid" {
+		t.Logf("wanted pid file in status, got %+v", st)
+		t.FailNow()
+	}
+
+	// someone deleted the socket, but the instance is still running
+	os.Remove(socket)
+	_, err = New(socket)
+	if err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Log("wanted already running error, got:", err)
+		t.FailNow()
+	}
+	os.Remove(socket)
+
+	// runlevel 0 cleans up
+	srv.Runlevel(1)
+	srv.Runlevel(0)
+	if _, err := os.Stat(socket + ".pid"); !os.IsNotExist(err) {
+		t.Log("wanted pid file removed, got:", err)
+		t.FailNow()
+	}
+	if _, err := New(socket); err != nil {
+		t.Logf("tried to create socket after runlevel 0, got error: %v", err)
+		t.FailNow()
+	}
+}
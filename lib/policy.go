@@ -0,0 +1,208 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version of this program, sent in HELLO when taking over a running server,
+// and compared when Options.KickNewerOnly is set. It can be set with a
+// linker flag (-X github.com/aerth/diamond/lib.Version=1.2.3) or in main,
+// before New.
+var Version string
+
+// KickTokenFile holds a shared secret, sent in HELLO by New when taking
+// over a running server which requires one (Options.KickTokenFile)
+var KickTokenFile string
+
+// hello is what a client said about itself in HELLO:
+// "from NAME [version=V] [token=T]"
+type hello struct {
+	name    string
+	version string
+	token   string
+}
+
+func parseHello(arg string) (h hello) {
+	var name []string
+	for i, f := range strings.Fields(arg) {
+		switch {
+		case i == 0 && f == "from":
+		case strings.HasPrefix(f, "version="):
+			h.version = strings.TrimPrefix(f, "version=")
+		case strings.HasPrefix(f, "token="):
+			h.token = strings.TrimPrefix(f, "token=")
+		default:
+			name = append(name, f)
+		}
+	}
+	h.name = strings.Join(name, " ")
+	return h
+}
+
+// String leaves out the token
+func (h hello) String() string {
+	s := "from " + h.name
+	if h.version != "" {
+		s += " version=" + h.version
+	}
+	return s
+}
+
+// helloArg introduces a client, with our Version and a token if any
+func helloArg(name, token string) string {
+	arg := "from " + name
+	if Version != "" {
+		arg += " version=" + Version
+	}
+	if token != "" {
+		arg += " token=" + token
+	}
+	return arg
+}
+
+// readToken reads a shared secret from a file
+func readToken(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" || strings.ContainsAny(token, " \t\n") {
+		return "", fmt.Errorf("token file %s must hold one word", path)
+	}
+	return token, nil
+}
+
+// checkToken compares the token from HELLO with Options.KickTokenFile, if set
+func (s *System) checkToken(peer hello) error {
+	if s.Config.KickTokenFile == "" {
+		return nil
+	}
+	want, err := readToken(s.Config.KickTokenFile)
+	if err != nil {
+		return fmt.Errorf("could not read token: %v", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(want), []byte(peer.token)) != 1 {
+		return fmt.Errorf("bad token")
+	}
+	return nil
+}
+
+// refuseKick checks the KICK policy in Options against the client
+func (s *System) refuseKick(peer hello) error {
+	c := s.Config
+	if !c.Kickable {
+		return fmt.Errorf("not kickable")
+	}
+	if up := time.Since(s.started); up < c.KickMinUptime {
+		return fmt.Errorf("up for %v, less than %v", up.Round(time.Millisecond), c.KickMinUptime)
+	}
+	if err := s.checkToken(peer); err != nil {
+		return err
+	}
+	if c.KickNewerOnly && s.version != "" {
+		if peer.version == "" {
+			return fmt.Errorf("no version given, running %s", s.version)
+		}
+		if compareVersions(peer.version, s.version) < 0 {
+			return fmt.Errorf("version %s is older than %s", peer.version, s.version)
+		}
+	}
+	return nil
+}
+
+// compareVersions returns -1, 0 or 1 as version a is older, the same or
+// newer than b. Versions are dotted numbers with an optional leading "v"
+// and "-prerelease", which is older than the version without it.
+// Build metadata ("+build") is ignored.
+func compareVersions(a, b string) int {
+	a, b = strings.TrimPrefix(a, "v"), strings.TrimPrefix(b, "v")
+	acore, apre := splitPre(a)
+	bcore, bpre := splitPre(b)
+	as, bs := strings.Split(acore, "."), strings.Split(bcore, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y string
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		if c := comparePart(x, y); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case apre == bpre:
+		return 0
+	case apre == "":
+		return 1
+	case bpre == "":
+		return -1
+	case apre < bpre:
+		return -1
+	}
+	return 1
+}
+
+// splitPre splits "1.2.3-rc1+build" into "1.2.3" and "rc1"
+func splitPre(v string) (core, pre string) {
+	if i := strings.Index(v, "+"); i >= 0 {
+		v = v[:i]
+	}
+	if i := strings.Index(v, "-"); i >= 0 {
+		return v[:i], v[i+1:]
+	}
+	return v, ""
+}
+
+// comparePart compares numerically if both are numbers (missing is 0)
+func comparePart(x, y string) int {
+	if x == "" {
+		x = "0"
+	}
+	if y == "" {
+		y = "0"
+	}
+	n, err1 := strconv.Atoi(x)
+	m, err2 := strconv.Atoi(y)
+	if err1 != nil || err2 != nil {
+		n, m = strings.Compare(x, y), 0
+	}
+	switch {
+	case n < m:
+		return -1
+	case n > m:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,169 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompareVersions(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"v1.2.3", "1.2.3", 0},
+		{"1.2.3+build5", "1.2.3", 0},
+		{"1.2.10", "1.2.9", 1},
+		{"1.2", "1.2.1", -1},
+		{"1.2.0", "1.2", 0},
+		{"2.0.0-rc1", "2.0.0", -1},
+		{"2.0.0-rc2", "2.0.0-rc1", 1},
+		{"1.10.0", "1.9.9", 1},
+	} {
+		if got := compareVersions(tc.a, tc.b); got != tc.want {
+			t.Logf("compareVersions(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+			t.Fail()
+		}
+	}
+}
+
+func TestParseHello(t *testing.T) {
+	h := parseHello("from ADMIN version=1.2 token=secret")
+	if h.name != "ADMIN" || h.version != "1.2" || h.token != "secret" {
+		t.Logf("unexpected %+v", h)
+		t.FailNow()
+	}
+	if strings.Contains(h.String(), "secret") {
+		t.Log("token in", h.String())
+		t.FailNow()
+	}
+}
+
+// kickable starts a kickable server, returning its socket
+func kickable(t *testing.T, configure func(*Options)) string {
+	srv, socket := createTestServer(t)
+	srv.Config.Kickable = true
+	configure(srv.Config)
+	if err := srv.Runlevel(1); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	return socket
+}
+
+func tokenFile(t *testing.T, token string) string {
+	f, err := ioutil.TempFile("", "testtoken")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	f.WriteString(token + "\n")
+	f.Close()
+	return f.Name()
+}
+
+func TestKickToken(t *testing.T) {
+	defer func(s string) { KickTokenFile = s }(KickTokenFile)
+	good := tokenFile(t, "s3cret")
+	defer os.Remove(good)
+	bad := tokenFile(t, "guess")
+	defer os.Remove(bad)
+	socket := kickable(t, func(o *Options) { o.KickTokenFile = good })
+	defer os.Remove(socket)
+
+	KickTokenFile = ""
+	if _, err := New(socket); err == nil || !strings.Contains(err.Error(), "bad token") {
+		t.Log("wanted KICK without token refused, got:", err)
+		t.FailNow()
+	}
+	KickTokenFile = bad
+	if _, err := New(socket); err == nil || !strings.Contains(err.Error(), "bad token") {
+		t.Log("wanted KICK with wrong token refused, got:", err)
+		t.FailNow()
+	}
+	KickTokenFile = good
+	if _, err := New(socket); err != nil {
+		t.Log("wanted KICK with token, got:", err)
+		t.FailNow()
+	}
+}
+
+func TestKickNewerOnly(t *testing.T) {
+	defer func(v string) { Version = v }(Version)
+	Version = "1.2.0"
+	socket := kickable(t, func(o *Options) { o.KickNewerOnly = true })
+	defer os.Remove(socket)
+
+	Version = "1.1.9"
+	if _, err := New(socket); err == nil || !strings.Contains(err.Error(), "older") {
+		t.Log("wanted KICK from older version refused, got:", err)
+		t.FailNow()
+	}
+	Version = "1.2.1"
+	if _, err := New(socket); err != nil {
+		t.Log("wanted KICK from newer version, got:", err)
+		t.FailNow()
+	}
+}
+
+func TestKickMinUptime(t *testing.T) {
+	socket := kickable(t, func(o *Options) { o.KickMinUptime = 300 * time.Millisecond })
+	defer os.Remove(socket)
+	if _, err := New(socket); err == nil || !strings.Contains(err.Error(), "less than") {
+		t.Log("wanted KICK refused before minimum uptime, got:", err)
+		t.FailNow()
+	}
+	time.Sleep(300 * time.Millisecond)
+	if _, err := New(socket); err != nil {
+		t.Log("wanted KICK after minimum uptime, got:", err)
+		t.FailNow()
+	}
+}
+
+func TestClientToken(t *testing.T) {
+	good := tokenFile(t, "s3cret")
+	defer os.Remove(good)
+	socket := kickable(t, func(o *Options) { o.KickTokenFile = good })
+	defer os.Remove(socket)
+	client, err := NewClient(socket)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if _, err := client.Send("KICK"); err == nil {
+		t.Log("wanted KICK without token refused")
+		t.FailNow()
+	}
+	client.Token = "s3cret"
+	if reply, err := client.Send("KICK"); err != nil || reply != "OKAY" {
+		t.Logf("wanted OKAY, got %q %v", reply, err)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,335 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ListenerLoader returns the listeners a System should have, see ReloadListeners
+type ListenerLoader func() ([]ListenerConfig, error)
+
+// ReloadResult is what ReloadListeners changed, by listener name or address
+type ReloadResult struct {
+	Added     []string `json:",omitempty"`
+	Removed   []string `json:",omitempty"`
+	Changed   []string `json:",omitempty"` // new address, type or certificate files
+	Reloaded  []string `json:",omitempty"` // tls, same files loaded again
+	Unchanged int
+}
+
+func (r ReloadResult) String() string {
+	var parts []string
+	for _, p := range []struct {
+		what  string
+		names []string
+	}{{"added", r.Added}, {"removed", r.Removed}, {"changed", r.Changed}, {"reloaded", r.Reloaded}} {
+		if len(p.names) > 0 {
+			parts = append(parts, p.what+" "+strings.Join(p.names, ", "))
+		}
+	}
+	parts = append(parts, fmt.Sprintf("%d unchanged", r.Unchanged))
+	return strings.Join(parts, "; ")
+}
+
+// SetListenerLoader sets where ReloadListeners, and RELOAD with no
+// argument, read listener definitions. Config.New sets one reading its file.
+func (s *System) SetListenerLoader(fn ListenerLoader) {
+	s.locklevel.Lock()
+	defer s.locklevel.Unlock()
+	s.listenerLoader = fn
+}
+
+// ReloadListeners reads listener definitions from a config file (path, see
+// LoadConfig), or the ListenerLoader if path is empty, and applies the
+// difference without going through runlevel 1. Listeners are matched by
+// name, or by address if unnamed. Certificates of tls listeners are
+// loaded again, even from the same files.
+//
+// In runlevel 3 or 4, new listeners are opened before any is closed, and
+// removed ones stop accepting and drain their connections
+// (Options.DrainTimeout) while the rest keep serving. A tls listener with
+// only a new certificate keeps its socket. If a listener can not be opened,
+// nothing changes, except for a listener moving to an address being closed,
+// which can only open after.
+func (s *System) ReloadListeners(path string) (*ReloadResult, error) {
+	var defs []ListenerConfig
+	var err error
+	if path != "" {
+		var c *Config
+		if c, err = LoadConfig(path); err == nil {
+			defs = c.Listeners
+		}
+	} else {
+		s.locklevel.Lock()
+		fn := s.listenerLoader
+		s.locklevel.Unlock()
+		if fn == nil {
+			return nil, fmt.Errorf("no config file or listener loader to reload from")
+		}
+		if defs, err = fn(); err == nil {
+			err = checkListeners(defs)
+		}
+	}
+	if err != nil {
+		s.event("reload failed: %v", err)
+		return nil, err
+	}
+	return s.applyListeners(defs)
+}
+
+// checkListeners validates definitions from a ListenerLoader, as in a config file
+func checkListeners(defs []ListenerConfig) error {
+	d := &configDecoder{file: "listener loader"}
+	for i := range defs {
+		d.check(fmt.Sprintf("listeners[%d].", i), &defs[i], true)
+	}
+	d.unique(defs)
+	return d.err
+}
+
+// ident matches a listener to its definition
+func ident(name, laddr string) string {
+	if name != "" {
+		return "name " + name
+	}
+	return laddr
+}
+
+// reload is a listener to add, or to change
+type reload struct {
+	l     *listener // new, or the definition of a new certificate
+	old   *listener // replaced, if any
+	swap  bool      // only the certificate of old changes
+	cert  *tls.Certificate
+	ln    net.Listener // opened before anything is closed
+	after bool         // opened after closing, same address as one closing
+}
+
+// applyListeners makes s.listeners match defs
+func (s *System) applyListeners(defs []ListenerConfig) (*ReloadResult, error) {
+	s.locklevel.Lock()
+	defer s.locklevel.Unlock()
+	if s.handedoff {
+		return nil, fmt.Errorf("listeners were handed off")
+	}
+	current := make(map[string]*listener)
+	for _, l := range s.listeners {
+		current[ident(l.name, l.laddr)] = l
+	}
+	result := new(ReloadResult)
+	matched := make(map[*listener]bool)
+	var next []*listener
+	var changes []*reload
+	for _, d := range defs {
+		l := &listener{name: d.Name, ltype: d.Type, laddr: d.Addr, certFile: d.Cert, keyFile: d.Key}
+		label := d.Addr
+		if d.Name != "" {
+			label = d.Name
+		}
+		old := current[ident(d.Name, d.Addr)]
+		switch {
+		case old == nil:
+			result.Added = append(result.Added, label)
+		case old.ltype == l.ltype && old.laddr == l.laddr && old.certFile == l.certFile && old.keyFile == l.keyFile:
+			matched[old] = true
+			next = append(next, old)
+			if l.ltype == "tls" {
+				// renewed in place, under the same paths
+				changes = append(changes, &reload{l: l, old: old, swap: true})
+				result.Reloaded = append(result.Reloaded, label)
+				continue
+			}
+			result.Unchanged++
+			continue
+		case old.ltype == "tls" && l.ltype == "tls" && old.laddr == l.laddr:
+			matched[old] = true
+			next = append(next, old)
+			changes = append(changes, &reload{l: l, old: old, swap: true})
+			result.Changed = append(result.Changed, label)
+			continue
+		default:
+			matched[old] = true
+			result.Changed = append(result.Changed, label)
+		}
+		l.counters = new(counters)
+		next = append(next, l)
+		changes = append(changes, &reload{l: l, old: old})
+	}
+	var closing []*listener // removed, or replaced
+	closingAddr := make(map[string]bool)
+	for _, l := range s.listeners {
+		if !matched[l] {
+			label := l.laddr
+			if l.name != "" {
+				label = l.name
+			}
+			result.Removed = append(result.Removed, label)
+		}
+		if !containsListener(next, l) {
+			closing = append(closing, l)
+			if l.listener != nil {
+				closingAddr[l.laddr] = true
+			}
+		}
+	}
+
+	// open everything that can be, before changing anything
+	if s.level == 3 || s.level == 4 {
+		for _, r := range changes {
+			var err error
+			if r.l.ltype == "tls" {
+				r.cert, err = loadCert(r.l)
+			}
+			if err == nil && !r.swap {
+				if closingAddr[r.l.laddr] {
+					r.after = true
+				} else {
+					r.ln, err = s.listen(r.l)
+				}
+			}
+			if err != nil {
+				for _, opened := range changes {
+					if opened.ln != nil {
+						opened.ln.Close()
+					}
+				}
+				s.event("reload failed: %s: %v", r.l.laddr, err)
+				return nil, err
+			}
+		}
+	}
+
+	s.listeners = next
+	for _, r := range changes {
+		switch {
+		case r.swap:
+			r.old.certFile, r.old.keyFile = r.l.certFile, r.l.keyFile
+			if r.old.tls != nil && r.cert != nil {
+				r.old.tls.setCert(r.cert)
+				s.event("new certificate for %s", r.old.laddr)
+			}
+		case r.ln != nil:
+			s.serve(r.l, r.ln, r.cert)
+		}
+	}
+	for _, l := range closing {
+		if l.listener != nil {
+			s.event("closing listener: %s", l.laddr)
+			if err := l.listener.Close(); err != nil {
+				s.log(LevelError, "error closing listener", FieldListener, l.laddr, FieldError, err)
+			}
+			l.listener, l.tls = nil, nil
+			go s.drainListener(l)
+		}
+		if l.file != nil {
+			l.file.Close()
+			l.file = nil
+		}
+	}
+	var err error
+	for _, r := range changes {
+		if !r.after {
+			continue
+		}
+		ln, e := s.listen(r.l)
+		if e != nil {
+			s.event("error opening %s (%s): %v", r.l.laddr, r.l.ltype, e)
+			if err == nil {
+				err = fmt.Errorf("could not open %s after closing it: %v", r.l.laddr, e)
+			}
+			continue
+		}
+		s.serve(r.l, ln, r.cert)
+	}
+	s.metrics.setListeners(s.listeners)
+	s.event("reloaded listeners: %v", result)
+	return result, err
+}
+
+func containsListener(listeners []*listener, l *listener) bool {
+	for _, v := range listeners {
+		if v == l {
+			return true
+		}
+	}
+	return false
+}
+
+// drainListener waits for the connections of a closed listener to finish,
+// closing those still open after Options.DrainTimeout
+func (s *System) drainListener(l *listener) {
+	deadline := time.Now().Add(s.drainTimeout())
+	for l.counters.conns() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	var closed int
+	l.counters.open.Range(func(c, _ interface{}) bool {
+		c.(*countedConn).Close()
+		closed++
+		return true
+	})
+	s.event("drained listener %s, closed %d connections", l.laddr, closed)
+}
+
+// Reload applies listener definitions from the config file in arg, or the
+// ListenerLoader, replying with ReloadResult as JSON
+func (p *packet) Reload(arg string, reply *string) error {
+	r, err := p.parent.ReloadListeners(arg)
+	if err != nil {
+		*reply = "error"
+		return err
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		*reply = "error"
+		return err
+	}
+	*reply = string(b)
+	return nil
+}
+
+func (p *packet) RELOAD(arg string, reply *string) error {
+	return p.Reload(arg, reply)
+}
+
+// Reload sends the RELOAD command, with a config file path or "" for the
+// server's own ListenerLoader
+func (c *Client) Reload(path string) (*ReloadResult, error) {
+	reply, err := c.Send("RELOAD", path)
+	if err != nil {
+		return nil, err
+	}
+	r := new(ReloadResult)
+	if err := json.Unmarshal([]byte(reply), r); err != nil {
+		return nil, fmt.Errorf("bad reload reply: %v", err)
+	}
+	return r, nil
+}
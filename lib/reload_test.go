@@ -0,0 +1,262 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReloadListeners(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	srv.Config.DrainTimeout = time.Second
+	release := make(chan struct{})
+	srv.SetHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		fmt.Fprintln(w, "foo!")
+	}))
+	srv.AddNamedListener("a", "tcp", "127.0.0.1:30117")
+	srv.AddListener("tcp", "127.0.0.1:30118")
+	if _, err := srv.ReloadListeners(""); err == nil {
+		t.Log("expected error without a listener loader")
+		t.FailNow()
+	}
+	defs := []ListenerConfig{
+		{Addr: "127.0.0.1:30118"},
+		{Name: "c", Addr: "127.0.0.1:30119"},
+	}
+	srv.SetListenerLoader(func() ([]ListenerConfig, error) { return defs, nil })
+	if err := srv.Runlevel(3); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer srv.Runlevel(1)
+
+	// a request in progress on a removed listener finishes
+	got := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://127.0.0.1:30117/slow")
+		if err == nil {
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		got <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	client, err := NewClient(socket)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	result, err := client.Reload("")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	want := &ReloadResult{Added: []string{"c"}, Removed: []string{"a"}, Unchanged: 1}
+	if !reflect.DeepEqual(result, want) {
+		t.Logf("expected %v, got %v", want, result)
+		t.FailNow()
+	}
+	if level := srv.GetRunlevel(); level != 3 {
+		t.Logf("expected to stay in runlevel 3, got %d", level)
+		t.FailNow()
+	}
+	testGet(t, "127.0.0.1:30118")
+	testGet(t, "127.0.0.1:30119")
+	if _, err := net.Dial("tcp", "127.0.0.1:30117"); err == nil {
+		t.Log("expected removed listener to be closed")
+		t.FailNow()
+	}
+	close(release)
+	if err := <-got; err != nil {
+		t.Logf("expected request on removed listener to finish, got %v", err)
+		t.FailNow()
+	}
+	stats := srv.ListenerStats()
+	if len(stats) != 2 || stats[0].Addr != "127.0.0.1:30118" || stats[1].Name != "c" || !stats[1].Open {
+		t.Logf("unexpected listeners after reload: %+v", stats)
+		t.FailNow()
+	}
+
+	// nothing changes if a new listener can not open
+	taken, err := net.Listen("tcp", "127.0.0.1:30120")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer taken.Close()
+	defs = []ListenerConfig{{Addr: "127.0.0.1:30120"}}
+	if _, err := srv.ReloadListeners(""); err == nil {
+		t.Log("expected error opening an address in use")
+		t.FailNow()
+	}
+	testGet(t, "127.0.0.1:30118")
+	testGet(t, "127.0.0.1:30119")
+	if n := srv.NListeners(); n != 2 {
+		t.Logf("expected 2 listeners after a failed reload, got %d", n)
+		t.FailNow()
+	}
+
+	// loaded definitions are checked as in a config file
+	defs = []ListenerConfig{{Addr: "127.0.0.1:30118"}, {Addr: "127.0.0.1:30118"}}
+	_, err = srv.ReloadListeners("")
+	if err == nil || err.Error() != `listener loader: listeners[1].addr: "127.0.0.1:30118" is also listeners[0]` {
+		t.Logf("expected duplicate address error, got %v", err)
+		t.FailNow()
+	}
+}
+
+func TestReloadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diamond-reload")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "new"), 0700)
+	certFile, keyFile := testCert(t, dir)
+	newCert, newKey := testCert(t, filepath.Join(dir, "new"))
+	socket := filepath.Join(dir, "web.sock")
+	config := `socket = %q
+[[listeners]]
+name = "https"
+type = "tls"
+addr = "127.0.0.1:30121"
+cert = %q
+key = %q
+[[listeners]]
+addr = "127.0.0.1:30122"
+`
+	path := writeConfig(t, dir, "web.toml", fmt.Sprintf(config, socket, certFile, keyFile))
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	s, err := c.New()
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	s.SetHandler(foohandler)
+	if err := s.Runlevel(c.Runlevel); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer s.Runlevel(0)
+
+	// a new certificate keeps the socket, and a listener is added
+	writeConfig(t, dir, "web.toml", fmt.Sprintf(config, socket, newCert, newKey)+`[[listeners]]
+addr = "127.0.0.1:30123"
+`)
+	result, err := s.ReloadListeners("")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	want := &ReloadResult{Added: []string{"127.0.0.1:30123"}, Changed: []string{"https"}, Unchanged: 1}
+	if !reflect.DeepEqual(result, want) {
+		t.Logf("expected %v, got %v", want, result)
+		t.FailNow()
+	}
+	pair, err := tls.LoadX509KeyPair(newCert, newKey)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://127.0.0.1:30121/")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	resp.Body.Close()
+	if !bytes.Equal(resp.TLS.PeerCertificates[0].Raw, pair.Certificate[0]) {
+		t.Log("expected the new certificate after reload")
+		t.FailNow()
+	}
+	testGet(t, "127.0.0.1:30123")
+
+	// a certificate renewed in place, under the same paths
+	testCert(t, filepath.Join(dir, "new"))
+	if result, err = s.ReloadListeners(""); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	want = &ReloadResult{Reloaded: []string{"https"}, Unchanged: 2}
+	if !reflect.DeepEqual(result, want) {
+		t.Logf("expected %v, got %v", want, result)
+		t.FailNow()
+	}
+	if pair, err = tls.LoadX509KeyPair(newCert, newKey); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	client.CloseIdleConnections()
+	if resp, err = client.Get("https://127.0.0.1:30121/"); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	resp.Body.Close()
+	if !bytes.Equal(resp.TLS.PeerCertificates[0].Raw, pair.Certificate[0]) {
+		t.Log("expected the renewed certificate after reload")
+		t.FailNow()
+	}
+
+	// in runlevel 1 only the definitions change, opening in runlevel 3
+	if err := s.Runlevel(1); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	other := writeConfig(t, dir, "other.json", fmt.Sprintf(`{"socket": %q, "listeners": [{"addr": "127.0.0.1:30124"}]}`, socket))
+	if _, err := s.ReloadListeners(other); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if st := s.ListenerStats(); len(st) != 1 || st[0].Open {
+		t.Logf("expected one closed listener, got %+v", st)
+		t.FailNow()
+	}
+	if err := s.Runlevel(3); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	testGet(t, "127.0.0.1:30124")
+	s.Runlevel(1)
+}
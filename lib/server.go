@@ -32,7 +32,9 @@ import (
 	"net/rpc"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -44,11 +46,12 @@ var CHMODFILE os.FileMode = 0770
 
 // System listens on control socket, controlling listeners and runlevels
 type System struct {
+	conns int64 // open http connections (atomic, first for alignment)
 
 	// Config can be configured
 	Config *Options
 
-	// Log can be redirected
+	// Log can be redirected, or replaced with SetLogger
 	Log             *log.Logger
 	Server          *http.Server
 	listeners       []*listener
@@ -56,15 +59,52 @@ type System struct {
 	controlListener net.Listener
 	runlevels       map[int]RunlevelFunc // map[int](func() error)
 	level           int                  // current runlevel
+	entered         bool                 // level was entered, not only the zero value
 	locklevel       sync.Mutex           // runlevel lock only for shifting runlevels
 	done            chan int             // end
 	httpmux         http.Handler         // has ServeHTTP(w,r) method
+	started         time.Time            // for uptime
+	events          eventlog             // recent events
+	history         history              // recent runlevel transitions
+	logger          atomic.Value         // loggerBox, see SetLogger
+	pidfile         *os.File             // locked pid file, if any
+	signals         signals              // see SetSignal
+	sigmu           sync.Mutex           // signals and watchdog lock
+	activated       []*activated         // sockets passed in by systemd
+	watchdog        chan struct{}        // closed to stop the watchdog
+	upgrading       int32                // atomic, set during Upgrade
+	handedoff       bool                 // sockets belong to an upgraded process
+	saver           stateHandler         // see SetStateSaver
+	loader          stateHandler         // see SetStateLoader
+	received        *state               // from the previous process, until runlevel 3
+	kicked          *KickResult          // from the process taken over in New
+	version         string               // Version, when New was called
+	canarymu        sync.Mutex           // canary lock, before locklevel
+	canary          *canary              // see StartCanary
+	canaryView      atomic.Value         // *canary, for Status without canarymu
+	incumbent       int                  // pid, if this is a canary
+	promoteToken    string               // from CanaryEnv, expected with PROMOTE
+	metrics         metrics              // see ServeMetrics
+	debug           *http.Server         // pprof and expvar, in runlevel 4
+	debugListener   *net.UnixListener
+	tlsConns        sync.Map       // *tls.Conn to *countedConn, see tlsListener
+	listenerLoader  ListenerLoader // see SetListenerLoader
+	boot            bootState      // see Boot
+	names           runlevelNames  // see NameRunlevel
 }
 
 type listener struct {
+	name     string // optional, to match a socket activated listener
 	ltype    string
 	laddr    string
 	listener net.Listener
+	file     *os.File // socket activated by systemd or inherited, if any
+	systemd  bool     // file belongs to systemd, leave the socket file alone
+	borrowed bool     // file belongs to the incumbent, see StartCanary
+	counters *counters
+	certFile string // for tls listeners
+	keyFile  string
+	tls      *tlsListener // serving, for tls listeners
 }
 
 func (l listener) String() string {
@@ -77,14 +117,39 @@ type RunlevelFunc func() error
 
 // Options modify how the diamond system functions
 type Options struct {
-	// More verbose output
+	// More verbose output, including LevelDebug messages
 	Verbose bool
 
 	// Able to be KICKed via control socket (same as command 'runlevel 0')
 	Kickable bool
 
+	// KICK (and STATE) must come after HELLO with the token in this file,
+	// a shared secret, if set. See KickTokenFile for the booting side.
+	KickTokenFile string
+
+	// Refuse KICK from a process with an older Version
+	KickNewerOnly bool
+
+	// Refuse KICK until up this long, so a crash looping new build
+	// can't keep kicking a healthy server
+	KickMinUptime time.Duration
+
 	// Force runlevel mode, regardless of errors
 	Force bool
+
+	// How long to wait for open connections to finish after an Upgrade,
+	// or when KICKed in drain or handoff mode (default 10s)
+	DrainTimeout time.Duration
+
+	// Write dumps (DUMP command and SIGUSR1, see Dump) to this file too
+	DumpFile string
+
+	// Runlevel to enter with Boot, such as 3
+	BootTarget int
+
+	// Runlevels to enter on the way to BootTarget, each after the Check
+	// of the one before passes (default: 1, then BootTarget)
+	BootSequence []BootStep
 }
 
 // NewServer returns a new server, and an error if the socket path is not valid
@@ -111,6 +176,13 @@ func (s *System) SetHandler(h http.Handler) error {
 
 // AddListener to the list of listeners, returning the
 func (s *System) AddListener(ltype, laddr string) (n int, err error) {
+	return s.AddNamedListener("", ltype, laddr)
+}
+
+// AddNamedListener is like AddListener, but named, to match the
+// FileDescriptorName of a socket activated by systemd.
+// Unnamed listeners are matched by address.
+func (s *System) AddNamedListener(name, ltype, laddr string) (n int, err error) {
 	if ltype == "" || laddr == "" {
 		return len(s.listeners), fmt.Errorf("Empty argument: %q %q", ltype, laddr)
 	}
@@ -119,9 +191,12 @@ func (s *System) AddListener(ltype, laddr string) (n int, err error) {
 		return n, fmt.Errorf("already listening on %v listeners, enter runlevel 1 first", n)
 	}
 	l := new(listener)
+	l.name = name
 	l.ltype = ltype
 	l.laddr = laddr
+	l.counters = new(counters)
 	s.listeners = append(s.listeners, l)
+	s.metrics.setListeners(s.listeners)
 	n = len(s.listeners)
 	return n, nil
 
@@ -158,49 +233,68 @@ func (s *System) NListeners() int {
 
 // New diamond system, listening at specified socket.
 func New(socket string) (*System, error) {
-	// does the socket already exist?
-	_, err := os.Stat(socket)
-	if err == nil {
-		// try to KICK. first, create client
-		client, err := NewClient(socket)
-		if err != nil {
-			return nil, fmt.Errorf("socket already exists and client could not be created: %v", err)
-		}
-
-		// send the KICK command
-		var resp string
-		resp, err = client.Send("KICK")
-		if err != nil {
-			return nil, fmt.Errorf("socket already exists and server isnt responding, delete if you want (error %v)", err)
-		}
-
-		// if it works, we get OKAY
-		if resp != "OKAY" {
-			return nil, fmt.Errorf("socket already exists and server responeded with: %q", resp)
-		}
-
-		// response was OKAY, no errors.
-		// this means we kicked the old server, and the socket *should* be removed.
-		// lets force remove the socket and continue as usual ;)
-		if _, err := os.Stat(socket); err == nil {
-			err = os.Remove(socket)
-			if err != nil {
-				return nil, fmt.Errorf("socket already exists and could not be removed: %q", err)
-			}
-		}
-	}
+	return newSystem(socket, &Options{})
+}
 
+// newSystem is New, with Options set before the control socket is served
+func newSystem(socket string, options *Options) (*System, error) {
 	srv := &System{
-		Config:        &Options{},
+		Config:        options,
 		Log:           log.New(os.Stderr, "[diamond] ", 0),
 		listeners:     nil,
 		controlSocket: socket,
 		runlevels:     make(map[int]RunlevelFunc),
 		done:          make(chan int, 1),
+		started:       time.Now(),
+		activated:     listenFDs(),
+		version:       Version,
+		names:         runlevelNames{byLevel: defaultNames()},
+	}
+	control := srv.inheritFDs()
+	if srv.incumbent, srv.promoteToken = canaryOf(); srv.incumbent != 0 {
+		socket += canarySuffix
+		srv.controlSocket = socket
 	}
 	srv.Server = &http.Server{
 		ConnState: srv.connState,
 	}
+
+	// only one new process at a time may take over the socket
+	if err := os.MkdirAll(filepath.Dir(socket), CHMODDIR); err != nil {
+		return nil, fmt.Errorf("diamond: Could not create service path")
+	}
+	lock, err := lockTakeover(socket + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	defer unlockTakeover(lock)
+
+	// upgraded in place, the old process is handing over the socket
+	if control != nil {
+		srv.controlListener = control
+		srv.event("using control socket inherited from pid %d", os.Getppid())
+		srv.serveControlSocket()
+		return srv, nil
+	}
+
+	if srv.incumbent != 0 {
+		// a canary never kicks, the incumbent keeps running
+		if alive, _ := SocketAlive(socket); alive {
+			return nil, fmt.Errorf("canary already running on %s", socket)
+		}
+		os.Remove(socket)
+	} else {
+		// does the socket already exist?
+		if err := srv.takeover(socket); err != nil {
+			return nil, err
+		}
+
+		// is another instance running, without its socket?
+		if pid := lockedBy(pidFilePath(socket)); pid != 0 {
+			return nil, fmt.Errorf("already running as pid %d (see %s)", pid, pidFilePath(socket))
+		}
+	}
+
 	// create and start listening on socket
 	err = srv.listenControlSocket()
 	if err != nil {
@@ -223,18 +317,55 @@ func (s *System) GetRunlevel() int {
 }
 
 // Runlevel switches gears, into the specified level.
+// See RunlevelNamed for names such as "serving".
 // func main() typically should os.Exit(0) some time after s.Wait()
-func (s *System) Runlevel(level int) (err error) {
+func (s *System) Runlevel(level int) error {
+	return s.RunlevelBy(level, "api")
+}
+
+// RunlevelBy is Runlevel, with who asked for it kept in History
+func (s *System) RunlevelBy(level int, requester string) (err error) {
 	s.locklevel.Lock()
 	defer s.locklevel.Unlock()
-	if s.level == 0 && level != 1 {
+	from := s.level
+	start := time.Now()
+	s.history.begin(Transition{Time: start, From: from, To: level, Requester: requester})
+	s.notifyShifting(from, level)
+	defer func() {
+		took := time.Since(start)
+		if _, ok := s.runlevels[level]; ok || level >= 0 && level <= 4 {
+			s.metrics.transition(from, level, s.level, took, err)
+		}
+		s.metrics.setListeners(s.listeners)
+		t := Transition{Time: start, From: from, To: level, Level: s.level, Requester: requester, Took: took, Result: "ok"}
+		if err != nil {
+			t.Result, t.Error = "error", err.Error()
+		}
+		s.history.add(t)
+		if s.level == level {
+			s.entered = true
+		}
+		s.notifyRunlevel(from, level, err)
+		if err != nil {
+			s.record(fmt.Sprintf("runlevel %v -> %v failed: %v", from, level, err))
+			s.log(LevelError, fmt.Sprintf("runlevel %v -> %v failed", from, level),
+				FieldRunlevel, s.level, FieldDuration, took, FieldError, err)
+			return
+		}
+		s.record(fmt.Sprintf("runlevel %v -> %v", from, level))
+		s.log(LevelInfo, fmt.Sprintf("runlevel %v -> %v", from, level), FieldRunlevel, level, FieldDuration, took)
+	}()
+	if s.entered && s.level == 0 && level != 1 {
 		if e := s.closelisteners(); e != nil {
 			return e
 		}
 	}
-	if s.level == level {
+	if s.entered && s.level == level {
 		return fmt.Errorf("already in runlevel %v", level)
 	}
+	if level >= 3 {
+		s.deliverState()
+	}
 	if fn, ok := s.runlevels[level]; ok {
 		err = fn()
 		if err != nil {
@@ -243,24 +374,37 @@ func (s *System) Runlevel(level int) (err error) {
 
 		s.level = level
 	}
+	if level != 4 {
+		s.closeDebug()
+	}
 	switch level {
 	default:
 	case 0:
 		// remove listener sockets if exists
 		for _, v := range s.listeners {
-			if v.ltype == "unix" {
-				s.Log.Println("removing http socket:", v.laddr)
+			if v.ltype == "unix" && !v.systemd && !v.borrowed && !s.handedoff {
+				s.log(LevelDebug, "removing http socket", FieldListener, v.laddr)
 				if e := os.Remove(v.laddr); e != nil {
-					s.Log.Printf("error removing socket: %v", e)
+					s.log(LevelWarn, "error removing socket", FieldListener, v.laddr, FieldError, e)
 				}
 			}
 		}
 
+		s.level = level
+		s.removePIDFile()
+		s.SetWatchdog(nil)
+		s.closeMetrics()
+
+		if s.handedoff {
+			s.done <- 0
+			return nil
+		}
+
 		// remove control socket file
-		s.Log.Println("removing socket")
+		s.log(LevelDebug, "removing socket "+s.controlSocket)
 		err = os.Remove(s.controlSocket)
 		if err != nil {
-			s.Log.Println(err)
+			s.log(LevelError, "error removing socket", FieldError, err)
 			s.done <- 111
 			return err
 		}
@@ -268,10 +412,28 @@ func (s *System) Runlevel(level int) (err error) {
 		return nil
 	case 1:
 		// close all connection (TCP or http unix socket)
-		return s.closelisteners()
+		if err = s.closelisteners(); err != nil {
+			return err
+		}
+		s.level = level
+		return nil
 	case 3:
 		// open all listeners (TCP or http unix socket)
-		return s.openlisteners()
+		if err = s.openlisteners(); err != nil {
+			return err
+		}
+		s.level = level
+		return nil
+	case 4:
+		// serving as in runlevel 3, with pprof and expvar on the debug socket
+		if err = s.openlisteners(); err != nil {
+			return err
+		}
+		if err = s.openDebug(); err != nil {
+			return err
+		}
+		s.level = level
+		return nil
 	}
 
 	if s.level == level {
@@ -296,21 +458,23 @@ func (s *System) listenControlSocket() error {
 		return fmt.Errorf("diamond: Could not change permissions on socket file: %v", err)
 	}
 
-	// start listening
+	s.serveControlSocket()
+	return nil
+}
+
+// serveControlSocket accepts connections on the control socket until it is closed
+func (s *System) serveControlSocket() {
 	go func() {
 		for {
 			e := s.socketAccept()
 			if e != nil {
-				s.Log.Printf("FATAL ADMIN SOCKET %s", e.Error())
-				continue
-			}
-			if s.Config.Verbose {
-				s.Log.Printf("Admin Socket Connection Completed: %s", time.Now().Format(time.Kitchen))
+				if strings.Contains(e.Error(), "use of closed") {
+					return
+				}
+				s.log(LevelError, "control socket", FieldError, e)
 			}
-
 		}
 	}()
-	return nil
 }
 
 // socketAccept one connection on unix socket, offering public methods on the 'packet' type
@@ -319,20 +483,21 @@ func (s *System) socketAccept() error {
 	if err != nil {
 		return fmt.Errorf("diamond: Could not accept connection: %v", err)
 	}
-	s.Log.Println("Received connection", time.Now().Format(time.Kitchen))
 	rcpServer := rpc.NewServer()
 	var pack = new(packet)
 	pack.parent = s
+	pack.conn = conn
 	if err = rcpServer.RegisterName("Diamond", pack); err != nil {
 		return fmt.Errorf("diamond: %s",
 			err.Error())
 	}
 	go func() {
-		if conn != nil {
-			s.Log.Println("Got conn:", conn.LocalAddr().String())
-		}
-		rcpServer.ServeConn(conn)
+		s.log(LevelDebug, "control connection")
+		rcpServer.ServeCodec(newControlCodec(conn, s, pack))
 		conn.Close()
+		if pack.after != nil {
+			pack.after()
+		}
 	}()
 
 	return nil
@@ -0,0 +1,140 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// exit is os.Exit, unless testing
+var exit = os.Exit
+
+// signals maps caught signals to functions, through the normal Runlevel path
+type signals struct {
+	fns  map[os.Signal]RunlevelFunc
+	busy map[os.Signal]bool
+	c    chan os.Signal
+}
+
+// SetSignal catches sig, running fn each time it is received.
+// If sig is received again while fn is still running, the process exits
+// immediately. A nil fn stops catching sig.
+//
+//	s.SetSignal(syscall.SIGTERM, s.Shift(0))
+//	s.SetSignal(syscall.SIGHUP, s.Restart)
+func (s *System) SetSignal(sig os.Signal, fn RunlevelFunc) {
+	s.sigmu.Lock()
+	defer s.sigmu.Unlock()
+	if fn == nil {
+		if s.signals.fns != nil {
+			delete(s.signals.fns, sig)
+			signal.Reset(sig)
+		}
+		return
+	}
+	if s.signals.fns == nil {
+		s.signals.fns = make(map[os.Signal]RunlevelFunc)
+		s.signals.busy = make(map[os.Signal]bool)
+		s.signals.c = make(chan os.Signal, 4)
+		go s.catchSignals()
+	}
+	s.signals.fns[sig] = fn
+	signal.Notify(s.signals.c, sig)
+}
+
+// DefaultSignals catches SIGINT and SIGTERM (runlevel 0), SIGHUP (Hangup)
+// and SIGUSR1 (LogDump)
+func (s *System) DefaultSignals() {
+	s.SetSignal(syscall.SIGINT, s.Shift(0))
+	s.SetSignal(syscall.SIGTERM, s.Shift(0))
+	s.SetSignal(syscall.SIGHUP, s.Hangup)
+	s.SetSignal(syscall.SIGUSR1, s.LogDump)
+}
+
+// Shift returns a RunlevelFunc that switches to level, for use with SetSignal
+func (s *System) Shift(level int) RunlevelFunc {
+	return func() error {
+		return s.RunlevelBy(level, "signal")
+	}
+}
+
+// Hangup reloads the listeners (see ReloadListeners) if there is a config
+// file or ListenerLoader to read them from, and otherwise Restarts
+func (s *System) Hangup() error {
+	s.locklevel.Lock()
+	loader := s.listenerLoader
+	s.locklevel.Unlock()
+	if loader != nil {
+		_, err := s.ReloadListeners("")
+		return err
+	}
+	return s.Restart()
+}
+
+// Restart switches to runlevel 1 and back to the current runlevel,
+// closing and reopening all listeners
+func (s *System) Restart() error {
+	level := s.GetRunlevel()
+	if err := s.RunlevelBy(1, "restart"); err != nil {
+		return err
+	}
+	return s.RunlevelBy(level, "restart")
+}
+
+// LogStatus writes the current status to the log
+func (s *System) LogStatus() error {
+	s.log(LevelInfo, "status", "status", s.Status())
+	return nil
+}
+
+func (s *System) catchSignals() {
+	for sig := range s.signals.c {
+		s.sigmu.Lock()
+		fn, busy := s.signals.fns[sig], s.signals.busy[sig]
+		if fn != nil && !busy {
+			s.signals.busy[sig] = true
+		}
+		s.sigmu.Unlock()
+		if fn == nil {
+			continue
+		}
+		if busy {
+			s.event("caught %v again, exiting now", sig)
+			exit(1)
+			continue
+		}
+		s.event("caught %v", sig)
+		go func(sig os.Signal) {
+			if err := fn(); err != nil {
+				s.event("signal %v: %v", sig, err)
+			}
+			s.sigmu.Lock()
+			s.signals.busy[sig] = false
+			s.sigmu.Unlock()
+		}(sig)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSignalRunlevel(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	srv.SetRunlevel(1, func() error { return nil })
+	srv.SetSignal(syscall.SIGUSR2, srv.Shift(1))
+	defer srv.SetSignal(syscall.SIGUSR2, nil)
+
+	syscall.Kill(os.Getpid(), syscall.SIGUSR2)
+	for i := 0; srv.GetRunlevel() != 1; i++ {
+		if i > 100 {
+			t.Log("wanted runlevel 1 after signal, got", srv.GetRunlevel())
+			t.FailNow()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSignalTwiceExits(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	exited := make(chan int, 1)
+	exit = func(code int) { exited <- code }
+	defer func() { exit = os.Exit }()
+
+	started, release := make(chan bool), make(chan bool)
+	srv.SetSignal(syscall.SIGUSR2, func() error {
+		started <- true
+		<-release
+		return nil
+	})
+	defer srv.SetSignal(syscall.SIGUSR2, nil)
+	defer close(release)
+
+	syscall.Kill(os.Getpid(), syscall.SIGUSR2)
+	<-started
+	syscall.Kill(os.Getpid(), syscall.SIGUSR2)
+	select {
+	case code := <-exited:
+		if code == 0 {
+			t.Log("wanted non-zero exit code")
+			t.FailNow()
+		}
+	case <-time.After(3 * time.Second):
+		t.Log("timeout waiting for second signal to exit")
+		t.FailNow()
+	}
+}
+
+func TestHangup(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	srv.SetHandler(foohandler)
+	srv.AddListener("tcp", "127.0.0.1:30126")
+	if err := srv.Runlevel(3); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer srv.Runlevel(1)
+
+	// without a listener loader, through runlevel 1 and back
+	if err := srv.Hangup(); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if n := len(srv.History(0)); n != 3 {
+		t.Logf("expected a restart, got %d transitions", n)
+		t.FailNow()
+	}
+
+	// with one, listeners are reloaded in place
+	srv.SetListenerLoader(func() ([]ListenerConfig, error) {
+		return []ListenerConfig{{Addr: "127.0.0.1:30126"}, {Addr: "127.0.0.1:30127"}}, nil
+	})
+	if err := srv.Hangup(); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if n := len(srv.History(0)); n != 3 {
+		t.Logf("expected no runlevel transitions, got %d", n)
+		t.FailNow()
+	}
+	testGet(t, "127.0.0.1:30127")
+}
@@ -25,23 +25,34 @@
 package diamond
 
 import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
+	"net/rpc"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 type packet struct {
 	parent *System
+	conn   net.Conn // the control socket connection
+	after  func()   // run once the connection is done, if set
+	peer   hello    // from HELLO on this connection
 }
 
 func (p *packet) HELLO(arg string, reply *string) error {
-	p.parent.Log.Println(time.Now(), "HELLO", arg)
+	p.peer = parseHello(arg)
+	p.parent.event("HELLO %s", p.peer)
 	*reply = "HELLO from DIAMOND"
 	return nil
 }
 
 func (p *packet) Echo(arg string, reply *string) error {
-	p.parent.Log.Println(time.Now(), "Echo", arg)
 	if arg == "" {
 		return fmt.Errorf("empty argument")
 	}
@@ -49,32 +60,17 @@ func (p *packet) Echo(arg string, reply *string) error {
 	return nil
 }
 
-func (p *packet) Kick(arg string, reply *string) error {
-	p.parent.Log.Println(time.Now(), "Kick", arg)
-	if p.parent.Config.Kickable {
-		*reply = "OKAY"
-		p.parent.Runlevel(0)
-		return nil
-	}
-	*reply = "NOWAY"
-	return fmt.Errorf("NOWAY")
-}
-
-func (p *packet) KICK(arg string, reply *string) error {
-	return p.Kick(arg, reply)
-}
 func (p *packet) Runlevel(arg string, reply *string) error {
-	p.parent.Log.Println(time.Now(), "Runlevel", arg)
 	if arg == "" {
 		*reply = strconv.Itoa(p.parent.GetRunlevel())
 		return nil
 	}
-	n, err := strconv.Atoi(arg)
+	n, err := p.parent.ParseRunlevel(arg)
 	if err != nil {
 		*reply = "error"
 		return err
 	}
-	err = p.parent.Runlevel(n)
+	err = p.parent.RunlevelBy(n, p.requester())
 	if err != nil {
 		*reply = "error"
 		return err
@@ -82,3 +78,141 @@ func (p *packet) Runlevel(arg string, reply *string) error {
 	*reply = strconv.Itoa(p.parent.GetRunlevel())
 	return nil
 }
+
+func (p *packet) Status(arg string, reply *string) error {
+	b, err := json.Marshal(p.parent.Status())
+	if err != nil {
+		*reply = "error"
+		return err
+	}
+	*reply = string(b)
+	return nil
+}
+
+func (p *packet) STATUS(arg string, reply *string) error {
+	return p.Status(arg, reply)
+}
+
+// Upgrade execs a new binary (arg, or the same executable) in place,
+// replying with its pid once it is in runlevel 3.
+// It replaces the process like KICK does, and is refused the same way.
+func (p *packet) Upgrade(arg string, reply *string) error {
+	p.parent.event("UPGRADE %s %s", arg, p.peer)
+	if err := p.parent.refuseKick(p.peer); err != nil {
+		p.parent.event("refused UPGRADE: %v", err)
+		*reply = "NOWAY"
+		return fmt.Errorf("NOWAY: %v", err)
+	}
+	pid, err := p.parent.Upgrade(arg)
+	if err != nil {
+		*reply = "error"
+		return err
+	}
+	*reply = "OKAY " + strconv.Itoa(pid)
+	return nil
+}
+
+func (p *packet) UPGRADE(arg string, reply *string) error {
+	return p.Upgrade(arg, reply)
+}
+
+// controlCodec is net/rpc's gob codec, logging and counting each command
+type controlCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	s      *System
+	pack   *packet
+	closed bool
+
+	mu      sync.Mutex
+	seq     uint64 // of the request being read
+	pending map[uint64]pendingCommand
+}
+
+type pendingCommand struct {
+	start time.Time
+	arg   string
+}
+
+func newControlCodec(conn io.ReadWriteCloser, s *System, pack *packet) *controlCodec {
+	buf := bufio.NewWriter(conn)
+	return &controlCodec{
+		rwc:     conn,
+		dec:     gob.NewDecoder(conn),
+		enc:     gob.NewEncoder(buf),
+		encBuf:  buf,
+		s:       s,
+		pack:    pack,
+		pending: make(map[uint64]pendingCommand),
+	}
+}
+
+func (c *controlCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.seq = r.Seq
+	c.pending[r.Seq] = pendingCommand{start: time.Now()}
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *controlCodec) ReadRequestBody(body interface{}) error {
+	if err := c.dec.Decode(body); err != nil {
+		return err
+	}
+	if arg, ok := body.(*string); ok {
+		c.mu.Lock()
+		p := c.pending[c.seq]
+		p.arg = *arg
+		c.pending[c.seq] = p
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+func (c *controlCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	c.mu.Lock()
+	p := c.pending[r.Seq]
+	delete(c.pending, r.Seq)
+	c.mu.Unlock()
+	c.s.metrics.command(r.ServiceMethod, r.Error)
+	name := strings.ToUpper(strings.TrimPrefix(r.ServiceMethod, "Diamond."))
+	if name == "HELLO" || name == "PROMOTE" {
+		p.arg = "" // may have a token
+	}
+	fields := []interface{}{FieldCommand, strings.TrimSpace(name + " " + p.arg), FieldDuration, time.Since(p.start)}
+	if c.pack.peer.name != "" {
+		fields = append(fields, FieldPeer, c.pack.peer.name)
+	}
+	if r.Error != "" {
+		c.s.log(LevelWarn, "command failed", append(fields, FieldError, r.Error)...)
+	} else {
+		c.s.log(LevelInfo, "command", fields...)
+	}
+
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return err
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *controlCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
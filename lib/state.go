@@ -0,0 +1,196 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/rpc"
+	"os"
+)
+
+// MaxStateSize limits the application state passed to a new process
+var MaxStateSize = 4 << 20
+
+// state is application state on its way from the old process to the new one
+type state struct {
+	Version string `json:"version"` // set by SetStateSaver, checked by SetStateLoader
+	PID     int    `json:"pid"`     // process it came from
+	Data    []byte `json:"data"`
+}
+
+// stateHandler is a registered saver or loader
+type stateHandler struct {
+	version string
+	save    func() ([]byte, error)
+	load    func([]byte) error
+}
+
+// SetStateSaver registers a function that serializes application state
+// (caches, session tickets, counters) for the process replacing this one,
+// either by KICK or Upgrade. The version tag is compared with the one
+// given to SetStateLoader in the new process, and the state is rejected
+// if they differ. State may be no larger than MaxStateSize.
+// With KICK, state is saved just before the old process is kicked, while
+// it is still serving.
+func (s *System) SetStateSaver(version string, fn func() ([]byte, error)) {
+	s.locklevel.Lock()
+	defer s.locklevel.Unlock()
+	s.saver = stateHandler{version: version, save: fn}
+}
+
+// SetStateLoader registers a function that receives the state saved by the
+// previous process, called once before first entering runlevel 3. State
+// with a different version tag is dropped, and the loader is not called.
+// Handing over state is best effort: a new process should be able to start
+// without it.
+func (s *System) SetStateLoader(version string, fn func([]byte) error) {
+	s.locklevel.Lock()
+	defer s.locklevel.Unlock()
+	s.loader = stateHandler{version: version, load: fn}
+}
+
+// marshalState calls the state saver, if any. Caller holds locklevel.
+func (s *System) marshalState() ([]byte, error) {
+	if s.saver.save == nil {
+		return nil, nil
+	}
+	data, err := s.saver.save()
+	if err != nil {
+		return nil, fmt.Errorf("could not save state: %v", err)
+	}
+	if len(data) > MaxStateSize {
+		return nil, fmt.Errorf("state is %d bytes, more than MaxStateSize (%d)", len(data), MaxStateSize)
+	}
+	return json.Marshal(state{Version: s.saver.version, PID: os.Getpid(), Data: data})
+}
+
+// unmarshalState keeps state from the previous process until runlevel 3
+func (s *System) unmarshalState(b []byte) error {
+	var st state
+	if err := json.Unmarshal(b, &st); err != nil {
+		return fmt.Errorf("bad state: %v", err)
+	}
+	if len(st.Data) > MaxStateSize {
+		return fmt.Errorf("state is %d bytes, more than MaxStateSize (%d)", len(st.Data), MaxStateSize)
+	}
+	s.received = &st
+	s.event("received %d bytes of state (version %q) from pid %d", len(st.Data), st.Version, st.PID)
+	return nil
+}
+
+// readState reads state passed in a file by Upgrade
+func (s *System) readState(r io.Reader) error {
+	// json (base64) is larger than the data
+	b, err := ioutil.ReadAll(io.LimitReader(r, int64(MaxStateSize)*2+1024))
+	if err != nil {
+		return err
+	}
+	return s.unmarshalState(b)
+}
+
+// stateFile writes state, if any, to an unlinked temporary file for Upgrade
+func (s *System) stateFile() (*os.File, error) {
+	b, err := s.marshalState()
+	if err != nil || b == nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile("", "diamond-state")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	if _, err = f.Write(b); err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// fetchState asks the old process for its state before kicking it
+func (s *System) fetchState(c *rpc.Client) {
+	var reply string
+	if err := c.Call("Diamond.STATE", "", &reply); err != nil {
+		s.event("no state from old process: %v", err)
+		return
+	}
+	if reply == "" {
+		return // nothing registered
+	}
+	if err := s.unmarshalState([]byte(reply)); err != nil {
+		s.event("rejected state: %v", err)
+	}
+}
+
+// deliverState passes received state to the loader. Caller holds locklevel.
+func (s *System) deliverState() {
+	st := s.received
+	if st == nil {
+		return
+	}
+	s.received = nil
+	switch {
+	case s.loader.load == nil:
+		s.event("no state loader, dropping state from pid %d", st.PID)
+	case st.Version != s.loader.version:
+		s.event("rejected state from pid %d: version %q, want %q", st.PID, st.Version, s.loader.version)
+	default:
+		if err := s.loader.load(st.Data); err != nil {
+			s.event("error loading state from pid %d: %v", st.PID, err)
+			return
+		}
+		s.event("loaded state from pid %d", st.PID)
+	}
+}
+
+// State replies with the registered application state, or nothing.
+// Only a client allowed to KICK (see refuseKick) gets it.
+func (p *packet) State(arg string, reply *string) error {
+	if err := p.parent.refuseKick(p.peer); err != nil {
+		p.parent.event("refused STATE: %v", err)
+		return err
+	}
+	p.parent.locklevel.Lock()
+	b, err := p.parent.marshalState()
+	p.parent.locklevel.Unlock()
+	if err != nil {
+		p.parent.event("STATE: %v", err)
+		return err
+	}
+	if b != nil {
+		p.parent.event("STATE: sent %d bytes", len(b))
+	}
+	*reply = string(b)
+	return nil
+}
+
+func (p *packet) STATE(arg string, reply *string) error {
+	return p.State(arg, reply)
+}
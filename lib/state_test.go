@@ -0,0 +1,138 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// kickWithState starts a kickable server saving state, and a new server taking it over
+func kickWithState(t *testing.T, version string, data []byte) (*System, string) {
+	old, socket := createTestServer(t)
+	old.Config.Kickable = true
+	old.SetStateSaver(version, func() ([]byte, error) { return data, nil })
+	if err := old.Runlevel(1); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	srv, err := New(socket)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	return srv, socket
+}
+
+func TestStateHandoff(t *testing.T) {
+	srv, socket := kickWithState(t, "v1", []byte("counter=5"))
+	defer os.Remove(socket)
+	var got string
+	srv.SetStateLoader("v1", func(b []byte) error { got = string(b); return nil })
+	if got != "" {
+		t.Log("state loaded before runlevel 3")
+		t.FailNow()
+	}
+	if err := srv.Runlevel(3); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if got != "counter=5" {
+		t.Logf("expected state %q, got %q", "counter=5", got)
+		t.FailNow()
+	}
+}
+
+func TestStateVersionMismatch(t *testing.T) {
+	srv, socket := kickWithState(t, "v1", []byte("counter=5"))
+	defer os.Remove(socket)
+	called := false
+	srv.SetStateLoader("v2", func(b []byte) error { called = true; return nil })
+	if err := srv.Runlevel(3); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if called {
+		t.Log("loader called with incompatible state")
+		t.FailNow()
+	}
+	found := false
+	for _, e := range srv.Events(0) {
+		if strings.Contains(e.Text, `rejected state`) {
+			found = true
+		}
+	}
+	if !found {
+		t.Log("expected rejected state event")
+		t.FailNow()
+	}
+}
+
+func TestStateTooLarge(t *testing.T) {
+	defer func(n int) { MaxStateSize = n }(MaxStateSize)
+	MaxStateSize = 4
+	srv, socket := kickWithState(t, "v1", []byte("too large"))
+	defer os.Remove(socket)
+	if srv.received != nil {
+		t.Log("expected state over MaxStateSize to be refused")
+		t.FailNow()
+	}
+}
+
+func TestStateBeforeKick(t *testing.T) {
+	defer func(mode string) { KickMode = mode }(KickMode)
+	KickMode = KickDrain // state is asked for before KICK
+	srv, socket := kickWithState(t, "v1", []byte("counter=5"))
+	defer os.Remove(socket)
+	if srv.received == nil || string(srv.received.Data) != "counter=5" {
+		t.Logf("expected state before kick, got %+v", srv.received)
+		t.FailNow()
+	}
+	if k := srv.Kicked(); k == nil || k.Mode != KickDrain {
+		t.Logf("expected drain kick result, got %+v", k)
+		t.FailNow()
+	}
+}
+
+func TestStateRefused(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	srv.SetStateSaver("v1", func() ([]byte, error) { return []byte("secret"), nil })
+	client, err := NewClient(socket)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if reply, err := client.Send("STATE"); err == nil || reply != "" {
+		t.Logf("expected state refused when not kickable, got %q %v", reply, err)
+		t.FailNow()
+	}
+	srv.Config.Kickable = true
+	if reply, err := client.Send("STATE"); err != nil || !strings.Contains(reply, `"version":"v1"`) {
+		t.Logf("expected state when kickable, got %q %v", reply, err)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,110 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Status is a snapshot of a diamond system, as returned by the STATUS command
+type Status struct {
+	Socket    string          // path to control socket
+	PID       int             // process id owning the socket
+	Version   string          // Version of the program, if set
+	PIDFile   string          // path to locked pid file, if any
+	Level     int             // current runlevel
+	LevelName string          `json:",omitempty"` // see NameRunlevel
+	Listeners int             // number of configured listeners
+	Open      int             // number of listeners currently open
+	Conns     int64           // number of open http connections
+	Stats     []ListenerStats // connection counters for each listener
+	Started   time.Time       // when the system was created
+	Uptime    time.Duration   // time since Started
+	Debug     string          `json:",omitempty"` // pprof and expvar socket, in runlevel 4
+
+	// after Boot
+	Boot       string `json:",omitempty"` // Booting, Booted or BootFailed
+	BootTarget int    `json:",omitempty"`
+	BootError  string `json:",omitempty"`
+
+	// while a canary runs (see StartCanary)
+	Role        string    `json:",omitempty"` // "incumbent" or "canary"
+	Peer        int       `json:",omitempty"` // pid of the other process
+	PeerSocket  string    `json:",omitempty"` // control socket of the other process
+	CanaryUntil time.Time // when the canary is promoted, unless aborted
+}
+
+// Status returns a snapshot of the system
+func (s *System) Status() Status {
+	var st Status
+	s.canaryStatus(&st)
+	s.bootStatus(&st)
+	s.locklevel.Lock()
+	defer s.locklevel.Unlock()
+	st.Socket = s.controlSocket
+	st.PID = os.Getpid()
+	st.Version = s.version
+	st.Level = s.level
+	st.LevelName = s.names.name(s.level)
+	st.Listeners = len(s.listeners)
+	st.Conns = atomic.LoadInt64(&s.conns)
+	st.Started = s.started
+	st.Uptime = time.Since(s.started)
+	if s.incumbent != 0 {
+		st.Role, st.Peer = "canary", s.incumbent
+		st.PeerSocket = strings.TrimSuffix(s.controlSocket, canarySuffix)
+	}
+	if s.pidfile != nil {
+		st.PIDFile = s.pidfile.Name()
+	}
+	if s.debug != nil {
+		st.Debug = s.controlSocket + debugSuffix
+	}
+	for _, v := range s.listeners {
+		if v.listener != nil {
+			st.Open++
+		}
+	}
+	st.Stats = s.listenerStats()
+	return st
+}
+
+// Status sends the STATUS command and decodes the reply
+func (c *Client) Status() (*Status, error) {
+	reply, err := c.Send("STATUS")
+	if err != nil {
+		return nil, err
+	}
+	st := new(Status)
+	if err := json.Unmarshal([]byte(reply), st); err != nil {
+		return nil, fmt.Errorf("bad status reply: %v", err)
+	}
+	return st, nil
+}
@@ -0,0 +1,199 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// activated is a socket passed in by systemd socket activation
+type activated struct {
+	name     string // from LISTEN_FDNAMES
+	network  string // tcp or unix
+	addr     string // address it is bound to
+	file     *os.File
+	claimed  bool // matched to a listener
+	systemd  bool // passed in by systemd, not by an upgrading process
+	borrowed bool // still used by the incumbent, see StartCanary
+}
+
+// listenFDs returns the sockets passed in by systemd (LISTEN_FDS and
+// LISTEN_FDNAMES), if they are for this process
+func listenFDs() []*activated {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	var fds []*activated
+	for i := 0; i < n; i++ {
+		fd := 3 + i // SD_LISTEN_FDS_START
+		syscall.CloseOnExec(fd)
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		a, err := newActivated(name, os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd)))
+		if err != nil {
+			continue // not a listening socket
+		}
+		a.systemd = true
+		fds = append(fds, a)
+	}
+	return fds
+}
+
+// newActivated finds the address a passed in socket is bound to
+func newActivated(name string, f *os.File) (*activated, error) {
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	return &activated{
+		name:    name,
+		network: l.Addr().Network(),
+		addr:    l.Addr().String(),
+		file:    f,
+	}, nil
+}
+
+// matches is true if the passed in socket is for the listener, by name or address
+func (a *activated) matches(l *listener) bool {
+	if l.name != "" {
+		return a.name == l.name
+	}
+	if a.network != network(l.ltype) {
+		return false
+	}
+	if a.network == "unix" {
+		return a.addr == l.laddr
+	}
+	want, err1 := net.ResolveTCPAddr("tcp", l.laddr)
+	got, err2 := net.ResolveTCPAddr("tcp", a.addr)
+	if err1 != nil || err2 != nil || want.Port != got.Port {
+		return false
+	}
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return got.IP.IsUnspecified()
+	}
+	return want.IP.Equal(got.IP)
+}
+
+// claimActivated gives each listener its passed in socket, if any
+func (s *System) claimActivated() {
+	for _, l := range s.listeners {
+		if l.file != nil {
+			continue
+		}
+		for _, a := range s.activated {
+			if !a.claimed && a.matches(l) {
+				a.claimed = true
+				l.file = a.file
+				l.systemd = a.systemd
+				l.borrowed = a.borrowed
+				how := "inherited"
+				switch {
+				case a.systemd:
+					how = "socket activated"
+				case a.borrowed:
+					how = "borrowed"
+				}
+				s.event("using %s %s listener %q for %s", how, a.network, a.name, l.laddr)
+				break
+			}
+		}
+	}
+}
+
+// sdNotify sends state to the service manager, if NOTIFY_SOCKET is set
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if path[0] == '@' { // abstract namespace
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// notifyRunlevel tells the service manager about a runlevel change
+func (s *System) notifyRunlevel(from, level int, err error) {
+	if s.handedoff || s.incumbent != 0 {
+		return // the upgraded process (or the incumbent) talks to the service manager
+	}
+	var state string
+	switch {
+	case err != nil:
+		state = fmt.Sprintf("STATUS=runlevel %d, could not switch to %d: %v", from, level, err)
+	case level >= 3:
+		state = fmt.Sprintf("READY=1\nSTATUS=runlevel %d", level)
+	default:
+		state = fmt.Sprintf("STATUS=runlevel %d", level)
+	}
+	if e := sdNotify(state); e != nil {
+		s.log(LevelWarn, "error notifying service manager", FieldError, e)
+	}
+}
+
+// notifyShifting tells the service manager a runlevel change is starting
+func (s *System) notifyShifting(from, level int) {
+	if s.handedoff || s.incumbent != 0 {
+		return
+	}
+	var state string
+	switch {
+	case level == 0:
+		state = "STOPPING=1"
+	case from >= 3 && level < 3:
+		state = "RELOADING=1"
+	default:
+		return
+	}
+	if e := sdNotify(state); e != nil {
+		s.log(LevelWarn, "error notifying service manager", FieldError, e)
+	}
+}
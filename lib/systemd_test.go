@@ -0,0 +1,128 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// fakeActivation opens a socket like systemd would, returning it as if
+// it was passed in with LISTEN_FDS
+func fakeActivation(t *testing.T, name string) (*activated, net.Listener) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	a, err := newActivated(name, f)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	return a, l
+}
+
+func testGet(t *testing.T, addr string) {
+	resp, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if string(b) != "foo!\n" {
+		t.Logf(`expected "foo!\n", got %q`, b)
+		t.FailNow()
+	}
+}
+
+func TestSocketActivation(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	byaddr, l1 := fakeActivation(t, "")
+	defer l1.Close()
+	byname, l2 := fakeActivation(t, "web")
+	defer l2.Close()
+	srv.activated = []*activated{byname, byaddr}
+	srv.SetHandler(foohandler)
+	srv.AddListener("tcp", l1.Addr().String())
+	srv.AddNamedListener("web", "tcp", "127.0.0.1:1") // address is ignored
+
+	// systemd keeps its copy open, so reopening only works with the passed in socket
+	for _, level := range []int{3, 1, 3} {
+		if err := srv.Runlevel(level); err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+	testGet(t, l1.Addr().String())
+	testGet(t, l2.Addr().String())
+	srv.Runlevel(1)
+}
+
+func TestNotify(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	srv.SetRunlevel(1, func() error { return nil })
+
+	// fake service manager
+	path := socket + ".notify"
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	expect := func(want string) {
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Logf("wanted %q, got %q %v", want, buf[:n], err)
+			t.FailNow()
+		}
+	}
+	srv.Runlevel(3)
+	expect("READY=1\nSTATUS=runlevel 3")
+	srv.Runlevel(1)
+	expect("RELOADING=1")
+	expect("STATUS=runlevel 1")
+	srv.Runlevel(0)
+	expect("STOPPING=1")
+	expect("STATUS=runlevel 0")
+}
@@ -0,0 +1,229 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// SocketAlive dials a unix socket, returning false if nothing is listening
+// (such as after a crash) or it does not exist, and an error if it could
+// not be determined
+func SocketAlive(path string) (bool, error) {
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return true, nil
+	}
+	if os.IsNotExist(err) || isErrno(err, syscall.ECONNREFUSED) {
+		return false, nil
+	}
+	return false, err
+}
+
+func isErrno(err error, errno syscall.Errno) bool {
+	if op, ok := err.(*net.OpError); ok {
+		if sys, ok := op.Err.(*os.SyscallError); ok {
+			return sys.Err == errno
+		}
+	}
+	return false
+}
+
+// lockTakeover locks path (next to the socket) and writes our pid in it,
+// so two new processes can't claim the same socket at once
+func lockTakeover(path string) (*os.File, error) {
+	f, pid, err := lockFile(path)
+	if err != nil && pid != 0 {
+		return nil, fmt.Errorf("socket is being taken over by another process (pid %d)", pid)
+	}
+	return f, err
+}
+
+// lockFile creates and locks path, writing our pid in it. If another
+// process holds the lock, its pid is returned with the error.
+func lockFile(path string) (*os.File, int, error) {
+	for i := 0; i < 3; i++ {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not create lock file: %v", err)
+		}
+		if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			pid := readPid(f)
+			f.Close()
+			if pid == 0 {
+				pid = -1 // locked, but pid not written yet
+			}
+			return nil, pid, fmt.Errorf("%q is locked by pid %d", path, pid)
+		}
+
+		// the last owner may have removed it while we waited
+		fi, err1 := f.Stat()
+		fi2, err2 := os.Stat(path)
+		if err1 != nil || err2 != nil || !os.SameFile(fi, fi2) {
+			f.Close()
+			continue
+		}
+		f.Truncate(0)
+		fmt.Fprintf(f, "%d\n", os.Getpid())
+		return f, 0, nil
+	}
+	return nil, 0, fmt.Errorf("could not lock %q", path)
+}
+
+// lockedBy returns the pid holding a lock on path, or 0 if it is not locked
+func lockedBy(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err == nil {
+		return 0
+	}
+	if pid := readPid(f); pid != 0 {
+		return pid
+	}
+	return -1
+}
+
+// unlockTakeover removes the lock file, then unlocks it
+func unlockTakeover(f *os.File) {
+	os.Remove(f.Name())
+	f.Close()
+}
+
+// LockSocket locks the file next to a socket (socket + ".lock"), as New
+// does while it claims the socket, so two processes starting at once can't
+// both claim a stale one. Release it with UnlockSocket.
+func LockSocket(socket string) (*os.File, error) {
+	return lockTakeover(socket + ".lock")
+}
+
+// UnlockSocket removes and unlocks a file locked by LockSocket
+func UnlockSocket(f *os.File) {
+	unlockTakeover(f)
+}
+
+// readPid returns the pid written in a lock or pid file, or 0
+func readPid(f *os.File) int {
+	f.Seek(0, 0)
+	line, _ := bufio.NewReader(f).ReadString('\n')
+	pid, _ := strconv.Atoi(strings.TrimSpace(line))
+	return pid
+}
+
+// takeover the socket path from an old process, kicking it if it is alive,
+// or removing the socket if it is stale
+func (s *System) takeover(socket string) error {
+	if _, err := os.Stat(socket); err != nil {
+		return nil // nothing to take over
+	}
+	alive, err := SocketAlive(socket)
+	if err != nil {
+		return fmt.Errorf("socket already exists and could not be checked: %v", err)
+	}
+	if !alive {
+		s.log(LevelWarn, "removing stale socket "+socket)
+		if err := os.Remove(socket); err != nil {
+			return fmt.Errorf("socket is stale and could not be removed: %v", err)
+		}
+		return nil
+	}
+
+	// try to KICK. first, introduce ourselves on one connection
+	var token string
+	if KickTokenFile != "" {
+		if token, err = readToken(KickTokenFile); err != nil {
+			return fmt.Errorf("could not read KICK token: %v", err)
+		}
+	}
+	client, err := rpc.Dial("unix", socket)
+	if err != nil {
+		return fmt.Errorf("socket already exists and client could not be created: %v", err)
+	}
+	defer client.Close()
+	var resp string
+	name := "diamond-" + strconv.Itoa(os.Getpid())
+	if err = client.Call("Diamond.HELLO", helloArg(name, token), &resp); err != nil {
+		return fmt.Errorf("socket already exists and server isnt responding (error %v)", err)
+	}
+
+	// state from the old process, if any, before it goes away
+	// (in handoff mode, it comes with the reply)
+	if KickMode != KickHandoff {
+		s.fetchState(client)
+	}
+
+	// send the KICK command
+	var args []string
+	if KickMode != "" {
+		args = append(args, KickMode)
+		if KickDeadline > 0 {
+			args = append(args, KickDeadline.String())
+		}
+	}
+	err = client.Call("Diamond.KICK", strings.Join(args, " "), &resp)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "NOWAY") {
+			return fmt.Errorf("socket already exists and server refused KICK (%v)", err)
+		}
+		return fmt.Errorf("socket already exists and server isnt responding (error %v)", err)
+	}
+
+	// if it works, we get OKAY (older servers, or no mode) or a KickResult
+	if resp != "OKAY" {
+		var result KickResult
+		if err := json.Unmarshal([]byte(resp), &result); err != nil {
+			return fmt.Errorf("socket already exists and server responeded with: %q", resp)
+		}
+		s.kicked = &result
+		s.event("%v", result)
+		if len(result.State) > 0 {
+			if err := s.unmarshalState(result.State); err != nil {
+				s.event("rejected state: %v", err)
+			}
+		}
+	}
+
+	// response was OKAY, no errors.
+	// this means we kicked the old server, and the socket *should* be removed.
+	// lets force remove the socket and continue as usual ;)
+	if _, err := os.Stat(socket); err == nil {
+		err = os.Remove(socket)
+		if err != nil {
+			return fmt.Errorf("socket already exists and could not be removed: %q", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func tempSocket(t *testing.T) string {
+	socket, err := ioutil.TempFile("", "testsocket") // unique filename
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	os.Remove(socket.Name())
+	return socket.Name()
+}
+
+func TestNewStaleSocket(t *testing.T) {
+	socket := tempSocket(t)
+	defer os.Remove(socket)
+
+	// leave a socket file with nobody listening, like a crashed server
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if _, err := os.Stat(socket); err != nil {
+		t.Log("wanted stale socket file, got:", err)
+		t.FailNow()
+	}
+
+	if _, err := New(socket); err != nil {
+		t.Logf("tried to take over stale socket, got error: %v", err)
+		t.FailNow()
+	}
+	if _, err := os.Stat(socket + ".lock"); !os.IsNotExist(err) {
+		t.Log("wanted lock file removed, got:", err)
+		t.FailNow()
+	}
+}
+
+func TestNewLiveSocket(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+
+	// not kickable
+	if _, err := New(socket); err == nil {
+		t.Log("wanted error taking over live socket")
+		t.FailNow()
+	}
+	if srv.GetRunlevel() != 0 {
+		t.Log("old server should not have been kicked")
+		t.FailNow()
+	}
+}
+
+func TestNewTakeoverLocked(t *testing.T) {
+	socket := tempSocket(t)
+	defer os.Remove(socket)
+
+	// another process is starting
+	lock, err := lockTakeover(socket + ".lock")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	_, err = New(socket)
+	if err == nil || !strings.Contains(err.Error(), "taken over by another process") {
+		t.Log("wanted takeover lock error, got:", err)
+		t.FailNow()
+	}
+	unlockTakeover(lock)
+	if _, err := New(socket); err != nil {
+		t.Logf("tried to create socket after unlock, got error: %v", err)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,121 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// AddTLSListener is like AddNamedListener (name is optional), for https
+// on a tcp address. The certificate and key are loaded each time the
+// listener opens, and by ReloadListeners (RELOAD), which picks up renewed
+// files without closing the socket.
+func (s *System) AddTLSListener(name, laddr, certFile, keyFile string) (n int, err error) {
+	if certFile == "" || keyFile == "" {
+		return len(s.listeners), fmt.Errorf("tls listener on %q needs a certificate and key", laddr)
+	}
+	if n, err = s.AddNamedListener(name, "tls", laddr); err != nil {
+		return n, err
+	}
+	s.listeners[n-1].certFile = certFile
+	s.listeners[n-1].keyFile = keyFile
+	return n, nil
+}
+
+// network is "tcp" for tls listeners
+func network(ltype string) string {
+	if ltype == "tls" {
+		return "tcp"
+	}
+	return ltype
+}
+
+// tlsListener does the tls handshake on counted connections, remembering
+// the countedConn of each, since connState only sees the *tls.Conn
+type tlsListener struct {
+	net.Listener
+	config *tls.Config
+	s      *System
+
+	mu   sync.Mutex
+	cert *tls.Certificate // replaced by ReloadListeners
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tc := tls.Server(conn, l.config)
+	if cc, ok := conn.(*countedConn); ok {
+		l.s.tlsConns.Store(tc, cc)
+	}
+	return tc, nil
+}
+
+func (l *tlsListener) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cert, nil
+}
+
+// setCert serves cert from the next handshake on
+func (l *tlsListener) setCert(cert *tls.Certificate) {
+	l.mu.Lock()
+	l.cert = cert
+	l.mu.Unlock()
+}
+
+// loadCert loads the certificate and key of a tls listener
+func loadCert(l *listener) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// serveTLS wraps a counted listener, serving cert
+func (s *System) serveTLS(served net.Listener, cert *tls.Certificate) *tlsListener {
+	l := &tlsListener{Listener: served, s: s, cert: cert}
+	l.config = &tls.Config{GetCertificate: l.getCertificate}
+	return l
+}
+
+// countedOf is the countedConn of an http connection, if any
+func (s *System) countedOf(c net.Conn) *countedConn {
+	if cc, ok := c.(*countedConn); ok {
+		return cc
+	}
+	if tc, ok := c.(*tls.Conn); ok {
+		if cc, ok := s.tlsConns.Load(tc); ok {
+			return cc.(*countedConn)
+		}
+	}
+	return nil
+}
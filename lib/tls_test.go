@@ -0,0 +1,128 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert writes a self signed certificate and key for 127.0.0.1 in dir
+func testCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func TestTLSListener(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	dir, err := ioutil.TempDir("", "diamond-tls")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := testCert(t, dir)
+	if _, err := srv.AddTLSListener("https", "127.0.0.1:30113", "", ""); err == nil {
+		t.Log("expected error without certificate")
+		t.FailNow()
+	}
+	if _, err := srv.AddTLSListener("https", "127.0.0.1:30113", certFile, keyFile); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	srv.SetHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			w.Write([]byte("not tls\n"))
+			return
+		}
+		w.Write([]byte("foo!\n"))
+	}))
+	if err := srv.Runlevel(3); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer srv.Runlevel(1)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://127.0.0.1:30113/")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "foo!\n" {
+		t.Logf(`expected "foo!\n", got %q`, b)
+		t.FailNow()
+	}
+	client.CloseIdleConnections()
+	time.Sleep(100 * time.Millisecond)
+	st := srv.ListenerStats()[0]
+	if st.Type != "tls" || st.Accepted != 1 || st.Closed != 1 || st.Conns != 0 || st.BytesIn == 0 {
+		t.Logf("unexpected tls listener stats: %+v", st)
+		t.FailNow()
+	}
+	var tracked int
+	srv.tlsConns.Range(func(k, v interface{}) bool { tracked++; return true })
+	if tracked != 0 {
+		t.Logf("expected closed tls connections to be forgotten, %d left", tracked)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,345 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// UpgradeEnv describes the sockets passed to the new process by Upgrade
+const UpgradeEnv = "DIAMOND_UPGRADE"
+
+// UpgradeTimeout is how long Upgrade waits for the new process to reach runlevel 3
+var UpgradeTimeout = time.Minute
+
+// DefaultDrainTimeout is used when Options.DrainTimeout is not set
+var DefaultDrainTimeout = 10 * time.Second
+
+// inherited is one entry of UpgradeEnv, a socket passed in ExtraFiles
+type inherited struct {
+	FD      int    `json:"fd"`
+	Name    string `json:"name,omitempty"`    // listener name, if any
+	Control bool   `json:"control,omitempty"` // the control socket
+	Systemd bool   `json:"systemd,omitempty"` // originally from systemd
+	Borrow  bool   `json:"borrow,omitempty"`  // still used by the incumbent, see StartCanary
+	State   bool   `json:"state,omitempty"`   // application state, see SetStateSaver
+}
+
+// Upgrade starts a new binary (path, or the running executable if empty)
+// with the same arguments, passing it the control socket, all open
+// listeners, and state from SetStateSaver. Once the new process answers
+// on the control socket in runlevel 3, this one stops accepting, drains
+// open connections (Options.DrainTimeout) and shifts to runlevel 0,
+// leaving the socket files in place. Unlike starting a new process that KICKs this one,
+// there is never a moment with nobody listening.
+func (s *System) Upgrade(path string) (pid int, err error) {
+	return s.upgrade(path, os.Args[1:])
+}
+
+func (s *System) upgrade(path string, args []string) (pid int, err error) {
+	if !atomic.CompareAndSwapInt32(&s.upgrading, 0, 1) {
+		return 0, fmt.Errorf("upgrade already in progress")
+	}
+	defer atomic.StoreInt32(&s.upgrading, 0)
+	if path == "" {
+		if path, err = os.Executable(); err != nil {
+			return 0, err
+		}
+	}
+
+	s.locklevel.Lock()
+	files, fds, dups, err := s.upgradeFiles(false)
+	if err != nil {
+		s.locklevel.Unlock()
+		return 0, err
+	}
+	defer closeFiles(dups)
+
+	// the new process locks its own pid file
+	locked := s.pidfile != nil
+	s.removePIDFile()
+	cmd, exited, err := spawn(path, args, files, fds)
+	s.locklevel.Unlock()
+	if err != nil {
+		if locked {
+			s.LockPIDFile()
+		}
+		return 0, err
+	}
+	pid = cmd.Process.Pid
+	s.event("upgrading to %s (pid %d)", path, pid)
+
+	if err = waitServing(s.controlSocket, pid, exited, UpgradeTimeout); err != nil {
+		cmd.Process.Kill()
+		if locked {
+			s.LockPIDFile()
+		}
+		s.event("upgrade failed: %v", err)
+		return 0, err
+	}
+	s.event("upgraded to pid %d", pid)
+	if e := sdNotify("MAINPID=" + strconv.Itoa(pid)); e != nil {
+		s.log(LevelWarn, "error notifying service manager", FieldError, e)
+	}
+	go s.handoff()
+	return pid, nil
+}
+
+// spawn starts path with files (described by fds) from fd 3 up
+func spawn(path string, args []string, files []*os.File, fds []inherited, env ...string) (*exec.Cmd, chan error, error) {
+	b, err := json.Marshal(fds)
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Env = append(os.Environ(), UpgradeEnv+"="+string(b))
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+
+	// starting puts files in blocking mode, which is shared with our
+	// listeners, so set it back as soon as possible
+	nonblock := make([]bool, len(files))
+	for i, f := range files {
+		nonblock[i] = isNonblock(f)
+	}
+	err = cmd.Start()
+	for i, f := range files {
+		if nonblock[i] {
+			setNonblock(f)
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	return cmd, exited, nil
+}
+
+func isNonblock(f *os.File) (nb bool) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return false
+	}
+	rc.Control(func(fd uintptr) {
+		flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_GETFL, 0)
+		nb = errno == 0 && flags&syscall.O_NONBLOCK != 0
+	})
+	return nb
+}
+
+func setNonblock(f *os.File) {
+	if rc, err := f.SyscallConn(); err == nil {
+		rc.Control(func(fd uintptr) {
+			syscall.SetNonblock(int(fd), true)
+		})
+	}
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// upgradeFiles collects the control socket, state and open listeners, to be
+// passed in ExtraFiles (fd 3 and up). dups are copies to close after starting.
+// A canary only borrows the listeners.
+func (s *System) upgradeFiles(canary bool) (files []*os.File, fds []inherited, dups []*os.File, err error) {
+	type filer interface {
+		File() (*os.File, error)
+	}
+	if !canary {
+		fl, ok := s.controlListener.(filer)
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("control socket can not be passed on")
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		files = append(files, f)
+		dups = append(dups, f)
+		fds = append(fds, inherited{FD: 3, Control: true})
+		sf, err := s.stateFile()
+		if err != nil {
+			f.Close()
+			return nil, nil, nil, err
+		}
+		if sf != nil {
+			fds = append(fds, inherited{FD: 3 + len(files), State: true})
+			files = append(files, sf)
+			dups = append(dups, sf)
+		}
+	}
+	for _, l := range s.listeners {
+		if l.listener == nil {
+			continue // the new process opens it
+		}
+		f := l.file
+		if f == nil {
+			fl, ok := l.listener.(filer)
+			if !ok {
+				continue
+			}
+			if f, err = fl.File(); err != nil {
+				closeFiles(dups)
+				return nil, nil, nil, err
+			}
+			dups = append(dups, f)
+		}
+		fds = append(fds, inherited{FD: 3 + len(files), Name: l.name, Systemd: l.systemd, Borrow: canary})
+		files = append(files, f)
+	}
+	// the new process finds it by address, in ServeMetrics
+	if fl, ok := s.metrics.listener.(filer); ok {
+		f, err := fl.File()
+		if err != nil {
+			closeFiles(dups)
+			return nil, nil, nil, err
+		}
+		dups = append(dups, f)
+		fds = append(fds, inherited{FD: 3 + len(files), Borrow: canary})
+		files = append(files, f)
+	}
+	return files, fds, dups, nil
+}
+
+// waitServing polls a control socket until the new process answers in runlevel 3
+func waitServing(socket string, pid int, exited chan error, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case err := <-exited:
+			if err == nil {
+				err = fmt.Errorf("exit status 0")
+			}
+			return fmt.Errorf("new process exited: %v", err)
+		case <-deadline:
+			return fmt.Errorf("new process not in runlevel 3 after %v", timeout)
+		case <-tick.C:
+		}
+		// both processes accept on the socket for now, ask until the new one answers
+		reply, err := call(socket, "STATUS", "")
+		var status Status
+		if err != nil || json.Unmarshal([]byte(reply), &status) != nil {
+			continue
+		}
+		if status.PID == pid && status.Level >= 3 {
+			return nil
+		}
+	}
+}
+
+// handoff stops accepting on sockets now served by the upgraded process,
+// drains open connections and shifts to runlevel 0
+func (s *System) handoff() {
+	s.locklevel.Lock()
+	s.handedoff = true
+	// closing would remove the socket files the new process is using
+	if l, ok := s.controlListener.(*net.UnixListener); ok {
+		l.SetUnlinkOnClose(false)
+	}
+	for _, l := range s.listeners {
+		if l, ok := l.listener.(*net.UnixListener); ok {
+			l.SetUnlinkOnClose(false)
+		}
+	}
+	s.controlListener.Close()
+	s.locklevel.Unlock()
+
+	s.drain(0)
+	s.stop()
+}
+
+// call sends one command on a new connection to a control socket
+func call(socket, cmd, arg string) (string, error) {
+	c, err := rpc.Dial("unix", socket)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	var reply string
+	err = c.Call("Diamond."+cmd, arg, &reply)
+	return reply, err
+}
+
+// inheritFDs reads UpgradeEnv, adding inherited listeners to s.activated
+// and returning the control socket, if this process was started by Upgrade
+func (s *System) inheritFDs() net.Listener {
+	env := os.Getenv(UpgradeEnv)
+	os.Unsetenv(UpgradeEnv)
+	if env == "" {
+		return nil
+	}
+	var fds []inherited
+	if err := json.Unmarshal([]byte(env), &fds); err != nil {
+		s.log(LevelError, "bad "+UpgradeEnv, FieldError, err)
+		return nil
+	}
+	var control net.Listener
+	for _, in := range fds {
+		syscall.CloseOnExec(in.FD)
+		f := os.NewFile(uintptr(in.FD), "DIAMOND_UPGRADE_"+strconv.Itoa(in.FD))
+		if in.State {
+			if err := s.readState(f); err != nil {
+				s.event("rejected state: %v", err)
+			}
+			f.Close()
+			continue
+		}
+		if in.Control {
+			l, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				s.log(LevelError, "inherited control socket", FieldError, err)
+				continue
+			}
+			control = l
+			continue
+		}
+		a, err := newActivated(in.Name, f)
+		if err != nil {
+			f.Close()
+			continue
+		}
+		a.systemd = in.Systemd
+		a.borrowed = in.Borrow
+		s.activated = append(s.activated, a)
+	}
+	return control
+}
@@ -0,0 +1,160 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const upgradeAddr = "127.0.0.1:30102"
+
+// TestUpgradeChild is the new process started by TestUpgrade
+func TestUpgradeChild(t *testing.T) {
+	if os.Getenv(UpgradeEnv) == "" {
+		t.Skip("only run by TestUpgrade")
+	}
+	srv, err := New(os.Getenv("DIAMOND_TEST_SOCKET"))
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	var state string
+	srv.SetStateLoader("v1", func(b []byte) error { state = string(b); return nil })
+	srv.SetHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "child %d %s\n", os.Getpid(), state)
+	}))
+	srv.AddListener("tcp", upgradeAddr)
+	if err := srv.Runlevel(3); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	srv.Wait()
+}
+
+func TestUpgrade(t *testing.T) {
+	socket := tempSocket(t)
+	defer os.Remove(socket)
+	srv, err := New(socket)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	srv.SetHandler(foohandler)
+	srv.AddListener("tcp", upgradeAddr)
+	if err := srv.Runlevel(3); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	testGet(t, upgradeAddr)
+	srv.SetStateSaver("v1", func() ([]byte, error) { return []byte("counter=5"), nil })
+
+	os.Setenv("DIAMOND_TEST_SOCKET", socket)
+	defer os.Unsetenv("DIAMOND_TEST_SOCKET")
+	pid, err := srv.upgrade(os.Args[0], []string{"-test.run=^TestUpgradeChild$"})
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// old process drains and stops
+	done := make(chan int)
+	go func() { done <- srv.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Log("old process did not reach runlevel 0")
+		t.FailNow()
+	}
+
+	// new process has the listener and control socket
+	resp, err := http.Get("http://" + upgradeAddr + "/")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if want := fmt.Sprintf("child %d counter=5\n", pid); string(b) != want {
+		t.Logf("expected %q, got %q", want, b)
+		t.FailNow()
+	}
+	client, err := NewClient(socket)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	status, err := client.Status()
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if status.PID != pid || status.Level != 3 {
+		t.Logf("expected pid %d in runlevel 3, got %+v", pid, status)
+		t.FailNow()
+	}
+
+	// new process cleans up the socket when it stops
+	client.Send("runlevel", "0")
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(socket); os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Log("new process did not remove socket")
+	t.FailNow()
+}
+
+func TestUpgradeRefused(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	token := tokenFile(t, "s3cret")
+	defer os.Remove(token)
+	client, err := NewClient(socket)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if reply, err := client.Send("upgrade", "/bin/false"); err == nil || !strings.Contains(err.Error(), "not kickable") {
+		t.Logf("expected upgrade refused when not kickable, got %q %v", reply, err)
+		t.FailNow()
+	}
+	srv.Config.Kickable = true
+	srv.Config.KickTokenFile = token
+	if reply, err := client.Send("upgrade", "/bin/false"); err == nil || !strings.Contains(err.Error(), "bad token") {
+		t.Logf("expected upgrade refused without token, got %q %v", reply, err)
+		t.FailNow()
+	}
+	if st, err := client.Status(); err != nil || st.PID != os.Getpid() {
+		t.Logf("expected pid %d still serving, got %+v %v", os.Getpid(), st, err)
+		t.FailNow()
+	}
+}
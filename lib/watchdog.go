@@ -0,0 +1,169 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Watchdog checks the health of the system, sending keepalives while healthy
+type Watchdog struct {
+	// Time between checks, by default half of WATCHDOG_USEC (set by systemd), or 10s
+	Interval time.Duration
+
+	// Check is an optional liveness check, in addition to the built in check
+	// that all open listeners are accepting connections
+	Check func() error
+
+	// Keepalive is called after each healthy check, by default sending
+	// WATCHDOG=1 to NOTIFY_SOCKET
+	Keepalive func() error
+
+	// After Failures checks in a row fail, switch to the Degraded runlevel
+	// (by default DefaultDegraded). Zero Failures never switches.
+	// A watchdog never shuts down the process, so Degraded is never 0.
+	Failures int
+	Degraded int
+}
+
+// DefaultDegraded is the runlevel a Watchdog switches to if Degraded is 0
+var DefaultDegraded = 2
+
+// SetWatchdog starts checking health with w, replacing any running watchdog.
+// A nil w stops the watchdog.
+func (s *System) SetWatchdog(w *Watchdog) {
+	s.sigmu.Lock()
+	defer s.sigmu.Unlock()
+	if s.watchdog != nil {
+		close(s.watchdog)
+		s.watchdog = nil
+	}
+	if w == nil {
+		return
+	}
+	wd := *w
+	if wd.Interval <= 0 {
+		wd.Interval = watchdogInterval()
+	}
+	if wd.Degraded == 0 {
+		wd.Degraded = DefaultDegraded
+	}
+	if wd.Keepalive == nil {
+		wd.Keepalive = func() error { return sdNotify("WATCHDOG=1") }
+	}
+	s.watchdog = make(chan struct{})
+	go s.runWatchdog(&wd, s.watchdog)
+}
+
+// watchdogInterval is half the systemd watchdog timeout, or 10s
+func watchdogInterval() time.Duration {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		err = fmt.Errorf("not for us")
+	}
+	if err != nil || usec <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+func (s *System) runWatchdog(w *Watchdog, stop chan struct{}) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	var failures int
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		err := s.Healthy()
+		if err == nil && w.Check != nil {
+			err = w.Check()
+		}
+		if err == nil {
+			failures = 0
+			if e := w.Keepalive(); e != nil {
+				s.log(LevelWarn, "watchdog keepalive", FieldError, e)
+			}
+			continue
+		}
+		failures++
+		s.event("watchdog: unhealthy (%d in a row): %v", failures, err)
+		if w.Failures > 0 && failures >= w.Failures && s.GetRunlevel() != w.Degraded {
+			s.event("watchdog: switching to runlevel %d after %d failed checks", w.Degraded, failures)
+			if e := s.RunlevelBy(w.Degraded, "watchdog"); e != nil {
+				s.log(LevelError, "watchdog", FieldRunlevel, w.Degraded, FieldError, e)
+			}
+			failures = 0
+		}
+	}
+}
+
+// Healthy checks that every open listener is accepting connections. It
+// asks the socket itself, without connecting, so no connection is counted,
+// served or logged.
+func (s *System) Healthy() error {
+	s.locklevel.Lock()
+	defer s.locklevel.Unlock()
+	for _, l := range s.listeners {
+		if l.listener == nil {
+			continue
+		}
+		if err := listening(l.listener); err != nil {
+			return fmt.Errorf("listener %s not accepting: %v", l, err)
+		}
+	}
+	return nil
+}
+
+// listening checks SO_ACCEPTCONN on the socket of ln
+func listening(ln net.Listener) error {
+	sc, ok := ln.(syscall.Conn)
+	if !ok {
+		return nil // not a socket we can ask
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var accepting int
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		accepting, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
+	})
+	if err == nil {
+		err = serr
+	}
+	if err == nil && accepting == 0 {
+		err = fmt.Errorf("not listening")
+	}
+	return err
+}
@@ -0,0 +1,141 @@
+/*
+* The MIT License (MIT)
+*
+* Copyright (c) 2016,2017  aerth <aerth@riseup.net>
+*
+* Permission is hereby granted, free of charge, to any person obtaining a copy
+* of this software and associated documentation files (the "Software"), to deal
+* in the Software without restriction, including without limitation the rights
+* to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+* copies of the Software, and to permit persons to whom the Software is
+* furnished to do so, subject to the following conditions:
+*
+* The above copyright notice and this permission notice shall be included in all
+* copies or substantial portions of the Software.
+*
+* THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+* IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+* FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+* AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+* LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+* OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+* SOFTWARE.
+ */
+
+package diamond
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWatchdog(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	srv.SetRunlevel(1, func() error { return nil })
+	srv.AddListener("tcp", "127.0.0.1:30101")
+	srv.SetHandler(foohandler)
+	if err := srv.Runlevel(3); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer srv.Runlevel(1)
+
+	keepalives := make(chan bool, 100)
+	sick := make(chan bool, 1)
+	srv.SetWatchdog(&Watchdog{
+		Interval: 10 * time.Millisecond,
+		Check: func() error {
+			select {
+			case <-sick:
+				sick <- true
+				return fmt.Errorf("sick")
+			default:
+				return nil
+			}
+		},
+		Keepalive: func() error { keepalives <- true; return nil },
+		Failures:  3,
+		Degraded:  1,
+	})
+	defer srv.SetWatchdog(nil)
+
+	select {
+	case <-keepalives:
+	case <-time.After(time.Second):
+		t.Log("timeout waiting for keepalive")
+		t.FailNow()
+	}
+
+	// degrade after 3 failures
+	sick <- true
+	for i := 0; srv.GetRunlevel() != 1; i++ {
+		if i > 100 {
+			t.Log("wanted degraded runlevel 1, got", srv.GetRunlevel())
+			t.FailNow()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for len(keepalives) > 0 {
+		<-keepalives
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(keepalives) != 0 {
+		t.Log("wanted no keepalives while unhealthy")
+		t.FailNow()
+	}
+}
+
+func TestWatchdogDefaultDegraded(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	srv.SetRunlevel(2, func() error { return nil })
+	if err := srv.Runlevel(3); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer srv.Runlevel(1)
+	srv.SetWatchdog(&Watchdog{
+		Interval:  10 * time.Millisecond,
+		Check:     func() error { return fmt.Errorf("sick") },
+		Keepalive: func() error { return nil },
+		Failures:  3,
+	})
+	defer srv.SetWatchdog(nil)
+	for i := 0; srv.GetRunlevel() != DefaultDegraded; i++ {
+		if i > 100 {
+			t.Logf("wanted degraded runlevel %d, got %d", DefaultDegraded, srv.GetRunlevel())
+			t.FailNow()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHealthyNoConnections(t *testing.T) {
+	srv, socket := createTestServer(t)
+	defer os.Remove(socket)
+	srv.SetHandler(foohandler)
+	srv.AddListener("tcp", "127.0.0.1:30129")
+	if err := srv.Runlevel(3); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer srv.Runlevel(1)
+	for i := 0; i < 3; i++ {
+		if err := srv.Healthy(); err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+	if st := srv.ListenerStats()[0]; st.Accepted != 0 {
+		t.Logf("wanted no connections from health checks, got %+v", st)
+		t.FailNow()
+	}
+	srv.listeners[0].listener.Close()
+	if err := srv.Healthy(); err == nil {
+		t.Log("wanted closed listener unhealthy")
+		t.FailNow()
+	}
+}
@@ -40,6 +40,8 @@ import (
 	"strings"
 	"syscall"
 	"time"
+
+	lib "github.com/aerth/diamond/lib"
 )
 
 const (
@@ -64,6 +66,7 @@ type Server struct {
 	cleanup    func() error
 	httpPairs  []httpPair
 	log        *logg.Logger
+	logger     lib.Logger // see SetLogger
 }
 
 type httpPair struct {
@@ -75,17 +78,43 @@ func (s Server) Log() *logg.Logger {
 	return s.log
 }
 
+// SetLogger sends log messages to l, such as lib.JSONLogger(os.Stderr),
+// instead of text to Log()
+func (s *Server) SetLogger(l lib.Logger) {
+	s.logger = l
+}
+
+func (s *Server) logs(level lib.Level, msg string, fields ...interface{}) {
+	if s.logger != nil {
+		s.logger.Log(level, msg, fields...)
+		return
+	}
+	lib.TextLoggerDepth(s.log, 1).Log(level, msg, fields...)
+}
+
 // New creates a new Server, with a socket at socketpath, and starts listening.
 //
 // Optional ptrs are pointers to types (`new(t)`) that contain methods
 // Each given of given ptrs must satisfy the criteria in the net/rpc package
 // See https://godoc.org/net/rpc for these criteria.
 func New(socketpath string, fnPointers ...interface{}) (*Server, error) {
-	l, err := net.Listen("unix", socketpath)
+	lock, err := lib.LockSocket(socketpath)
 	if err != nil {
-		if strings.Contains(err.Error(), "bind: address already in use") {
-			return nil, fmt.Errorf("%v\nDid a diamond server crash? You can delete the socket if you are sure that no other diamond servers are running.", err)
+		return nil, err
+	}
+	defer lib.UnlockSocket(lock)
+	l, err := net.Listen("unix", socketpath)
+	if err != nil && strings.Contains(err.Error(), "bind: address already in use") {
+		if alive, err2 := lib.SocketAlive(socketpath); err2 != nil || alive {
+			return nil, fmt.Errorf("%v\nAnother diamond server is running on this socket.", err)
+		}
+		// nobody is listening, the last server must have crashed
+		if err := os.Remove(socketpath); err != nil {
+			return nil, fmt.Errorf("could not remove stale socket: %v", err)
 		}
+		l, err = net.Listen("unix", socketpath)
+	}
+	if err != nil {
 		return nil, err
 	}
 
@@ -103,7 +132,7 @@ func New(socketpath string, fnPointers ...interface{}) (*Server, error) {
 	r := rpc.NewServer()
 	var pack = &packet{s}
 	if err := r.RegisterName("Diamond", pack); err != nil {
-		s.log.Println("err registering rpc name:", err)
+		s.logs(lib.LevelError, "registering rpc name", lib.FieldError, err)
 	}
 
 	for i := range s.fns {
@@ -114,12 +143,11 @@ func New(socketpath string, fnPointers ...interface{}) (*Server, error) {
 		typ := reflect.TypeOf(s.fns[i])
 		rcvr := reflect.ValueOf(s.fns[i])
 		sname := reflect.Indirect(rcvr).Type().Name()
-		s.log.Printf("Registered RPC type: %q", sname)
+		var methods []string
 		for m := 0; m < typ.NumMethod(); m++ {
-			method := typ.Method(m)
-			mname := method.Name
-			s.log.Printf("\t%s.%s()", sname, mname)
+			methods = append(methods, typ.Method(m).Name)
 		}
+		s.logs(lib.LevelInfo, "registered rpc type "+sname, "methods", strings.Join(methods, ","))
 
 	}
 	s.r = r
@@ -128,7 +156,7 @@ func New(socketpath string, fnPointers ...interface{}) (*Server, error) {
 		for {
 			conn, err := s.socket.Accept()
 			if err != nil {
-				s.log.Println("error:", err)
+				s.logs(lib.LevelError, "control socket", lib.FieldError, err)
 				continue
 			}
 			go s.handleConn(conn)
@@ -153,19 +181,28 @@ func (s *Server) AddHTTPHandler(addr string, h http.Handler) int {
 // Wait can be called to wait for the program to finish and remove the socket file.
 // It is not necessary to call Wait() if your program catches signals
 // and cleans up the socket file on it's own.
+//
+// On SIGINT, SIGHUP or SIGTERM, Runlevel(0) is entered (running HookLevel0).
+// A second signal while shutting down exits immediately.
 func (s *Server) Wait() error {
-	sigs := make(chan os.Signal)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGHUP)
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGHUP, syscall.SIGTERM)
+	defer signal.Stop(sigs)
 	var err error
 	select {
 	case err = <-s.quit:
 		if err2 := os.Remove(s.socketname); err2 != nil {
-			s.log.Println("error removing socket:", err2)
+			s.logs(lib.LevelWarn, "error removing socket", lib.FieldError, err2)
 		}
 	case sig := <-sigs:
-		s.log.Println("recv sig:", sig.String())
-		if err2 := os.Remove(s.socketname); err2 != nil {
-			s.log.Println("error removing socket:", err2)
+		s.logs(lib.LevelInfo, "received "+sig.String())
+		done := make(chan error, 1)
+		go func() { done <- s.Runlevel(0) }()
+		select {
+		case err = <-done:
+		case sig = <-sigs:
+			s.logs(lib.LevelWarn, "received "+sig.String()+" again, exiting now")
+			os.Exit(1)
 		}
 	}
 	return err
@@ -181,31 +218,31 @@ func (s *Server) Runlevel(level int) error {
 		return fmt.Errorf("invalid level: %d", level)
 	}
 	if s.runlevel == level {
-		s.log.Printf("warning: already in level %d", level)
+		s.logs(lib.LevelWarn, "already in runlevel", lib.FieldRunlevel, level)
 	}
 	switch level {
 	case 0:
-		s.log.Println("Shutting down...")
+		s.logs(lib.LevelInfo, "shutting down", lib.FieldRunlevel, level)
 		// close all listeners
 		for i := range s.listeners {
 			if err := s.listeners[i].Close(); err != nil {
-				s.log.Printf("error closing listener %d: %v", i, err)
+				s.logs(lib.LevelWarn, "error closing listener", lib.FieldListener, s.listeners[i].Addr(), lib.FieldError, err)
 			}
 		}
 		if s.HookLevel0 != nil {
 			s.listeners = s.HookLevel0()
 		}
 		if err := s.cleanup(); err != nil {
-			s.log.Println("error cleaning up:", err)
+			s.logs(lib.LevelError, "error cleaning up", lib.FieldError, err)
 		}
 		s.runlevel = 0
 		return nil
 	case 1:
-		s.log.Println("Entering runlevel 1...")
+		s.logs(lib.LevelInfo, "entering runlevel", lib.FieldRunlevel, level)
 		// close all listeners
 		for i := range s.listeners {
 			if err := s.listeners[i].Close(); err != nil {
-				s.log.Printf("error closing listener %d: %v", i, err)
+				s.logs(lib.LevelWarn, "error closing listener", lib.FieldListener, s.listeners[i].Addr(), lib.FieldError, err)
 			}
 		}
 		if s.HookLevel1 != nil {
@@ -213,11 +250,11 @@ func (s *Server) Runlevel(level int) error {
 		}
 		s.runlevel = 1
 	case 2:
-		s.log.Println("Entering runlevel 2...")
+		s.logs(lib.LevelInfo, "entering runlevel", lib.FieldRunlevel, level)
 		// close all listeners
 		for i := range s.listeners {
 			if err := s.listeners[i].Close(); err != nil {
-				s.log.Printf("error closing listener %d: %v", i, err)
+				s.logs(lib.LevelWarn, "error closing listener", lib.FieldListener, s.listeners[i].Addr(), lib.FieldError, err)
 			}
 		}
 		if s.HookLevel2 != nil {
@@ -226,7 +263,7 @@ func (s *Server) Runlevel(level int) error {
 		s.runlevel = 2
 
 	case 3:
-		s.log.Println("Entering runlevel 3...")
+		s.logs(lib.LevelInfo, "entering runlevel", lib.FieldRunlevel, level)
 		if s.HookLevel3 == nil && len(s.httpPairs) == 0 {
 			return fmt.Errorf("cant runlevel 3 with no listeners and no HookLevel3()")
 		}
@@ -237,7 +274,7 @@ func (s *Server) Runlevel(level int) error {
 		for i := range s.httpPairs {
 			l, err := net.Listen("tcp", s.httpPairs[i].Addr)
 			if err != nil {
-				s.log.Println("error listening:", err)
+				s.logs(lib.LevelError, "error listening", lib.FieldListener, s.httpPairs[i].Addr, lib.FieldError, err)
 				continue
 			}
 			listeners = append(listeners, l)
@@ -249,17 +286,17 @@ func (s *Server) Runlevel(level int) error {
 				IdleTimeout:    time.Second,
 			}
 			go func(l net.Listener, srv *http.Server) {
-				s.log.Println(srv.Serve(l))
+				s.logs(lib.LevelInfo, "no longer serving http", lib.FieldListener, l.Addr(), lib.FieldError, srv.Serve(l))
 			}(l, handler)
 		}
 		if len(listeners) > 0 {
 			s.listeners = append(s.listeners, listeners...)
 		}
-		s.log.Printf("auto http listeners: %d, total known listeners: %d", len(listeners), len(s.listeners))
+		s.logs(lib.LevelInfo, "listening", "http", len(listeners), "listeners", len(s.listeners))
 		s.runlevel = 3
 
 	case 4:
-		s.log.Println("Entering runlevel 4...")
+		s.logs(lib.LevelInfo, "entering runlevel", lib.FieldRunlevel, level)
 		if s.HookLevel4 != nil {
 			s.listeners = s.HookLevel4()
 		}
@@ -274,55 +311,39 @@ type packet struct {
 }
 
 func (p *packet) HELLO(arg string, reply *string) error {
-	p.parent.log.Printf("HELLO: %q", arg)
+	var peer []string
+	for _, f := range strings.Fields(arg) {
+		if !strings.HasPrefix(f, "token=") {
+			peer = append(peer, f)
+		}
+	}
+	p.parent.logs(lib.LevelInfo, "command", lib.FieldCommand, "HELLO", lib.FieldPeer, strings.Join(peer, " "))
 	*reply = "HELLO from Diamond Socket"
 	return nil
 }
 
-func (p *packet) RUNLEVEL(level string, reply *string) error {
-	p.parent.log.Printf("Request to shift runlevel: %q", level)
-	if len(level) != 1 {
-		*reply = "need runlevel to switch to (digit)"
+func (p *packet) RUNLEVEL(arg string, reply *string) error {
+	s := p.parent
+	s.logs(lib.LevelInfo, "command", lib.FieldCommand, "RUNLEVEL "+arg)
+	if arg == "" {
+		*reply = "need runlevel to switch to (digit or name)"
 		return nil
 	}
-	if fmt.Sprintf("%d", p.parent.runlevel) == level {
-		*reply = "already"
+	// the same numbers and names as a lib.System
+	level, err := lib.ParseRunlevel(arg)
+	if err != nil || level < 0 || level > 4 {
+		s.logs(lib.LevelWarn, "invalid runlevel", lib.FieldCommand, "RUNLEVEL "+arg)
 		return nil
 	}
-
-	s := p.parent
-	switch level {
-	case "0":
-		if err := p.parent.Runlevel(0); err != nil {
-			s.log.Println(err)
-		}
-		return nil
-	case "1":
-		if err := p.parent.Runlevel(1); err != nil {
-			s.log.Println(err)
-		}
-		*reply = fmt.Sprintf("level %d", p.parent.runlevel)
-		return nil
-	case "2":
-		if err := p.parent.Runlevel(2); err != nil {
-			s.log.Println(err)
-		}
-		*reply = fmt.Sprintf("level %d", p.parent.runlevel)
-		return nil
-	case "3":
-		if err := p.parent.Runlevel(3); err != nil {
-			s.log.Println(err)
-		}
-		*reply = fmt.Sprintf("level %d", p.parent.runlevel)
-		return nil
-	case "4":
-		if err := p.parent.Runlevel(4); err != nil {
-			s.log.Println(err)
-		}
-		*reply = fmt.Sprintf("level %d", p.parent.runlevel)
-		return nil
-	default:
-		s.log.Println("invalid arg:", level)
+	if level == s.runlevel {
+		*reply = "already"
 		return nil
 	}
+	if err := s.Runlevel(level); err != nil {
+		s.logs(lib.LevelError, "runlevel", lib.FieldError, err)
+	}
+	if level != 0 {
+		*reply = fmt.Sprintf("level %d", s.runlevel)
+	}
+	return nil
 }